@@ -0,0 +1,283 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+var ErrBindDenied = errors.New("bind address denied by policy")
+
+// Longest a bind host may take to resolve
+const bindResolveTimeout = 10 * time.Second
+
+// Addresses and ports remote tunnels may bind on the server, as GatewayPorts
+// does in OpenSSH. Binds without an address get the wildcard address if it
+// is allowed, loopback otherwise. Binds on port 0 get a free port of the
+// dynamic pool.
+type BindPolicy struct {
+	// Any address, the wildcard one included
+	anyAddress bool
+	networks   []*net.IPNet
+	interfaces []string
+	ports      []portRange
+	reserved   []portRange
+	dynamic    []portRange
+	// Ports of a narrowed down policy, all if empty
+	scoped []portRange
+}
+
+type portRange struct {
+	min int
+	max int
+}
+
+// Policy from RemoteBindAddresses, RemoteBindPorts, RemoteDynamicPorts and
+// ReservedPorts. The ports of own, the addresses the server listens on, are
+// reserved too.
+func BindPolicyConfig(own ...string) (*BindPolicy, error) {
+	policy := &BindPolicy{}
+
+	for _, address := range viper.GetStringSlice("RemoteBindAddresses") {
+		address = strings.TrimSpace(address)
+
+		switch {
+		case address == "*":
+			policy.anyAddress = true
+		case strings.Contains(address, "/"):
+			_, network, err := net.ParseCIDR(address)
+			if err != nil {
+				return nil, fmt.Errorf("invalid RemoteBindAddresses: %s", err)
+			}
+			policy.networks = append(policy.networks, network)
+		case net.ParseIP(address) != nil:
+			policy.networks = append(policy.networks, hostNetwork(net.ParseIP(address)))
+		default:
+			// Interface names, their addresses are looked up on every bind
+			policy.interfaces = append(policy.interfaces, address)
+		}
+	}
+
+	var err error
+
+	policy.ports, err = parsePortRanges(viper.GetStringSlice("RemoteBindPorts"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid RemoteBindPorts: %s", err)
+	}
+
+	policy.dynamic, err = parsePortRanges(viper.GetStringSlice("RemoteDynamicPorts"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid RemoteDynamicPorts: %s", err)
+	}
+
+	policy.reserved, err = parsePortRanges(viper.GetStringSlice("ReservedPorts"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid ReservedPorts: %s", err)
+	}
+
+	for _, address := range own {
+		if _, portName, err := net.SplitHostPort(address); err == nil {
+			if port, err := strconv.Atoi(portName); err == nil {
+				policy.reserved = append(policy.reserved, portRange{port, port})
+			}
+		}
+	}
+
+	return policy, nil
+}
+
+// A policy that only allows the ports both this one and ports do.
+func (self *BindPolicy) Narrow(ports []string) (*BindPolicy, error) {
+	ranges, err := parsePortRanges(ports)
+	if err != nil || len(ranges) == 0 {
+		return self, err
+	}
+
+	narrowed := BindPolicy{anyAddress: true, ports: []portRange{{0, 65535}}}
+	if self != nil {
+		narrowed = *self
+	}
+	narrowed.scoped = ranges
+
+	return &narrowed, nil
+}
+
+func parsePortRanges(specs []string) ([]portRange, error) {
+	ranges := make([]portRange, 0, len(specs))
+
+	for _, spec := range specs {
+		min, max, err := parsePortRange(strings.TrimSpace(spec))
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, portRange{min, max})
+	}
+
+	return ranges, nil
+}
+
+func inPortRanges(ranges []portRange, port int) bool {
+	for _, allowed := range ranges {
+		if port >= allowed.min && port <= allowed.max {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks a bind asked by a client. Returns the address to bind, with the
+// host resolved so it is the one checked, which gives up once ctx is done.
+// A nil policy allows everything.
+func (self *BindPolicy) Check(ctx context.Context, service string) (string, error) {
+	if self == nil {
+		return service, nil
+	}
+
+	// A bare port, as in -R 8080:host:port
+	if !strings.Contains(service, ":") {
+		service = ":" + service
+	}
+
+	host, portName, err := net.SplitHostPort(service)
+	if err != nil {
+		return "", err
+	}
+
+	port, err := strconv.Atoi(portName)
+	if err != nil || port < 0 || port > 65535 {
+		return "", fmt.Errorf("invalid port %q", portName)
+	}
+
+	switch {
+	case port == 0:
+		if len(self.dynamic) == 0 {
+			return "", fmt.Errorf("%w: no dynamic ports to assign", ErrBindDenied)
+		}
+	case inPortRanges(self.reserved, port):
+		return "", fmt.Errorf("%w: port %d is reserved", ErrBindDenied, port)
+	case !inPortRanges(self.ports, port), !self.inScope(port):
+		return "", fmt.Errorf("%w: port %d is not allowed", ErrBindDenied, port)
+	}
+
+	if host == "" {
+		if self.anyAddress {
+			return service, nil
+		}
+		host = "127.0.0.1"
+	}
+
+	ip := net.ParseIP(host)
+
+	if ip == nil {
+		ctx, cancel := context.WithTimeout(ctx, bindResolveTimeout)
+		addresses, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		cancel()
+
+		if err != nil {
+			return "", err
+		}
+
+		// net.Listen prefers IPv4 as well
+		ip = addresses[0].IP
+		for _, address := range addresses {
+			if address.IP.To4() != nil {
+				ip = address.IP
+				break
+			}
+		}
+	}
+
+	if !self.allowsAddress(ip) {
+		return "", fmt.Errorf("%w: %s", ErrBindDenied, net.JoinHostPort(host, portName))
+	}
+
+	return net.JoinHostPort(ip.String(), portName), nil
+}
+
+func (self *BindPolicy) allowsAddress(ip net.IP) bool {
+	if self.anyAddress {
+		return true
+	}
+
+	for _, network := range self.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	for _, name := range self.interfaces {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			continue
+		}
+
+		addresses, _ := iface.Addrs()
+		for _, address := range addresses {
+			if network, ok := address.(*net.IPNet); ok && network.IP.Equal(ip) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Tries the addresses to bind for service in order, until try returns false.
+// Port 0 gets the ports of the dynamic pool, from a random one so concurrent
+// binds rarely race for the same. Without a policy the system picks the
+// port. Returns how many addresses were tried.
+func (self *BindPolicy) tryCandidates(service string, try func(service string) bool) int {
+	host, portName, err := net.SplitHostPort(service)
+	if self == nil || err != nil || portName != "0" {
+		try(service)
+		return 1
+	}
+
+	size := 0
+	for _, pool := range self.dynamic {
+		size += pool.max - pool.min + 1
+	}
+
+	if size == 0 {
+		return 0
+	}
+
+	tried := 0
+	start := rand.Intn(size)
+
+	for i := 0; i < size; i++ {
+		port := self.dynamicPort((start + i) % size)
+		if port == 0 || inPortRanges(self.reserved, port) || !self.inScope(port) {
+			continue
+		}
+
+		tried++
+		if !try(net.JoinHostPort(host, strconv.Itoa(port))) {
+			break
+		}
+	}
+
+	return tried
+}
+
+// Port at index of the dynamic pool, its ranges laid one after the other.
+func (self *BindPolicy) dynamicPort(index int) int {
+	for _, pool := range self.dynamic {
+		if index <= pool.max-pool.min {
+			return pool.min + index
+		}
+		index -= pool.max - pool.min + 1
+	}
+	return 0
+}
+
+func (self *BindPolicy) inScope(port int) bool {
+	return len(self.scoped) == 0 || inPortRanges(self.scoped, port)
+}
@@ -0,0 +1,45 @@
+package common
+
+import (
+	"net"
+	"strconv"
+	"testing"
+)
+
+// Every allowed port of the dynamic pool is tried once, the reserved ones
+// and those out of scope never.
+func TestBindPolicyTriesDynamicPorts(t *testing.T) {
+	policy := &BindPolicy{
+		dynamic:  []portRange{{0, 3}, {10, 12}, {20, 20}},
+		reserved: []portRange{{11, 11}},
+		scoped:   []portRange{{0, 19}},
+	}
+
+	tried := make(map[int]int)
+	count := policy.tryCandidates("127.0.0.1:0", func(service string) bool {
+		_, portName, _ := net.SplitHostPort(service)
+		port, _ := strconv.Atoi(portName)
+		tried[port]++
+		return true
+	})
+
+	expected := []int{1, 2, 3, 10, 12}
+	if count != len(expected) || len(tried) != len(expected) {
+		t.Fatalf("tried %d ports %v, expected %v", count, tried, expected)
+	}
+	for _, port := range expected {
+		if tried[port] != 1 {
+			t.Errorf("port %d tried %d times", port, tried[port])
+		}
+	}
+}
+
+func TestBindPolicyStopsTrying(t *testing.T) {
+	policy := &BindPolicy{dynamic: []portRange{{1000, 1999}}}
+
+	count := policy.tryCandidates(":0", func(string) bool { return false })
+
+	if count != 1 {
+		t.Errorf("tried %d ports, expected to stop after the first", count)
+	}
+}
@@ -1,59 +1,559 @@
 package common
 
 import (
-	"github.com/alecthomas/log4go"
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/log4go"
+	"github.com/rsrdesarrollo/tunneler/messages"
 	"github.com/spf13/viper"
 )
 
+// Lifecycle of a client
+type ClientState int
+
+const (
+	// Waiting for the peer to connect it
+	ClientOpening ClientState = iota
+	ClientOpen
+	// One direction is done
+	ClientHalfClosed
+	ClientClosed
+)
+
+func (self ClientState) String() string {
+	switch self {
+	case ClientOpening:
+		return "opening"
+	case ClientOpen:
+		return "open"
+	case ClientHalfClosed:
+		return "half-closed"
+	default:
+		return "closed"
+	}
+}
+
+// Credit both ends assume for a client until the receiver grants its whole
+// ClientWindowSize.
+const initialWindow = 64 * 1024
+
+// Policies for a connection whose queue reaches ClientQueueLimit. The queue
+// never holds more with either policy, and the session reader never waits
+// for a connection.
+const (
+	// Grant window credit as data is written, so the peer waits for the
+	// connection to catch up. Peers without flow control can not be held
+	// back, their connections are reset.
+	QueueOverflowBlock = "block"
+	// Grant window credit as data is queued, and reset the connection once
+	// the queue is full
+	QueueOverflowReset = "reset"
+)
+
+var (
+	// A datagram did not fit the queue and was dropped
+	ErrQueueFull = errors.New("client queue full")
+	// The peer sent more data than the queue holds, and can not be held back
+	ErrQueueOverflow = errors.New("client queue over its limit")
+	// The peer sent more data than the credit it was granted
+	ErrWindowExceeded = errors.New("peer exceeded its window")
+	errClientClosed   = errors.New("client closed")
+)
+
 type Client struct {
-	id           string
-	connection   net.Conn
-	log          log4go.Logger
-	readyToClose bool
+	id         string
+	connection net.Conn
+	log        log4go.Logger
+
+	// Cancelled when the client or its tunnel is closed
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Guarded by mutex. Half-close: readDone once our EOF was sent to the
+	// peer, writeDone once the EOF of the peer was written out. Closed when
+	// both are done.
+	state     ClientState
+	readDone  bool
+	writeDone bool
+
+	// Datagram clients keep message boundaries and expire once idleTimeout
+	// passes without datagrams in either direction since lastActive
+	packet      bool
+	idleTimeout time.Duration
+	lastActive  time.Time
+
+	// Flow control. sendWindow is the credit the peer gave us, peerWindow the
+	// credit we gave the peer, queue the data from the peer waiting to be
+	// written, that never exceeds windowSize nor queueLimit.
+	flowControl     bool
+	windowSize      int
+	queueLimit      int
+	resetOnOverflow bool
+	mutex           sync.Mutex
+	cond            *sync.Cond
+	sendWindow      int
+	peerWindow      int
+	queue           [][]byte
+	queued          int
+	consumed        int
+	ungranted       int
 }
 
-func NewClient(id string, connetcion net.Conn, log log4go.Logger) *Client {
-	return &Client{
-		id:           id,
-		connection:   connetcion,
-		log:          log,
-		readyToClose: false,
+func NewClient(ctx context.Context, id string, connetcion net.Conn, flowControl bool, log log4go.Logger) *Client {
+	queueLimit := viper.GetInt("ClientQueueLimit")
+	if queueLimit < initialWindow {
+		queueLimit = initialWindow
+	}
+
+	// The peer is never granted more than the queue holds
+	windowSize := viper.GetInt("ClientWindowSize")
+	if windowSize < initialWindow {
+		windowSize = initialWindow
 	}
+	if windowSize > queueLimit {
+		windowSize = queueLimit
+	}
+
+	obj := &Client{
+		id:         id,
+		connection: connetcion,
+		log:        log,
+
+		flowControl:     flowControl,
+		windowSize:      windowSize,
+		queueLimit:      queueLimit,
+		resetOnOverflow: viper.GetString("ClientQueueOverflow") == QueueOverflowReset,
+		sendWindow:      initialWindow,
+		peerWindow:      initialWindow,
+		ungranted:       windowSize - initialWindow,
+	}
+	obj.cond = sync.NewCond(&obj.mutex)
+	obj.ctx, obj.cancel = context.WithCancel(ctx)
+
+	return obj
+}
+
+// Datagrams are not flow controlled, the ones that do not fit the queue are
+// dropped.
+func NewPacketClient(ctx context.Context, id string, connection net.Conn, idleTimeout time.Duration, log log4go.Logger) *Client {
+	client := NewClient(ctx, id, connection, false, log)
+	client.packet = true
+	client.idleTimeout = idleTimeout
+	client.lastActive = time.Now()
+	return client
 }
 
 func (self *Client) ClientHandler(point TunnelPoint) {
 	self.log.Debug("ClientHandler")
 
-	defer self.connection.Close()
+	// Stream reads fit a frame of the peer, datagrams are fragmented
+	bufferSize := viper.GetInt("ClientSocketBuffer")
+	if maxPayload := point.MaxPayloadSize(); bufferSize > maxPayload {
+		bufferSize = maxPayload
+	}
+	if self.packet {
+		bufferSize = maxDatagramSize
+	}
+
+	for self.ctx.Err() == nil {
+		if self.idleTimeout > 0 {
+			self.connection.SetReadDeadline(self.activeSince().Add(self.idleTimeout))
+		}
 
-	buffer := make([]byte, viper.GetInt("ClientSocketBuffer"))
+		readSize := self.acquireWindow(bufferSize)
+		if readSize == 0 {
+			break
+		}
+
+		// Handed over to the tunnel point along with the data
+		buffer := messages.GetBuffer(readSize)
 
-	for point.IsOpen() {
 		readLen, err := self.connection.Read(buffer)
+		self.spendWindow(readLen)
 
 		self.log.Trace("Client %s, read %d bytes '%s'", self.id, readLen, buffer[:readLen])
 
-		// TODO: Think something less memory heap cookie monster (e.g. circular buffer...)
-		data := make([]byte, readLen)
-		copy(data, buffer[:readLen])
+		if readLen == 0 {
+			messages.PutBuffer(buffer)
+		}
+
+		if self.packet {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				// Datagrams written meanwhile keep the session alive
+				if time.Since(self.activeSince()) < self.idleTimeout {
+					continue
+				}
+
+				// The peer forgets it too, so its next datagram opens a new one
+				self.log.Info("Client %s, idle for %s. Closing session", self.id, self.idleTimeout)
+				point.ResetClient(self.id, messages.ErrorCode.Timeout, fmt.Errorf("udp session idle for %s", self.idleTimeout))
+				break
+			}
+
+			if err != nil {
+				if !self.IsClosed() {
+					self.log.Error(err)
+					point.ResetClient(self.id, ErrorCodeOf(err), err)
+				}
+				break
+			}
+
+			self.touch()
 
-		point.ReceiveDataFromClientSocket(self, data)
+			// An empty payload means EOF in the tunnel, so empty datagrams are not forwarded
+			if readLen == 0 {
+				continue
+			}
+		}
+
+		if readLen > 0 {
+			point.ReceiveDataFromClientSocket(self, buffer[:readLen])
+		}
 
 		if err == io.EOF {
-			if self.readyToClose {
+			self.log.Trace("Client %s, read EOF", self.id)
+			point.ReceiveEOFFromClientSocket(self)
+
+			if self.halfClose(true) {
 				point.CloseClient(self.id)
-			} else {
-				self.readyToClose = true
 			}
 			break
 		}
 
 		if err != nil {
-			self.log.Error(err)
-			point.CloseClient(self.id)
+			if !self.IsClosed() {
+				self.log.Error(err)
+				point.ResetClient(self.id, ErrorCodeOf(err), err)
+			}
 			break
 		}
 	}
 }
+
+// Writes the data queued from the peer, so a slow client does not block the
+// session, and gives the peer credit back as it goes.
+func (self *Client) WriteHandler(point TunnelPoint) {
+	self.log.Debug("WriteHandler")
+
+	for {
+		data, ok := self.dequeue()
+
+		if !ok {
+			return
+		}
+
+		// An empty payload means EOF in the tunnel
+		if len(data) == 0 {
+			self.closeWrite(point)
+			return
+		}
+
+		writeLen, err := self.connection.Write(data)
+
+		self.log.Trace("Client %s, write %d bytes", self.id, writeLen)
+
+		if err != nil {
+			self.log.Error(err)
+			point.ResetClient(self.id, ErrorCodeOf(err), err)
+			return
+		}
+
+		if self.packet {
+			self.touch()
+		}
+
+		if credit := self.consume(len(data)); credit > 0 {
+			point.SendWindowUpdate(self, uint32(credit))
+		}
+	}
+}
+
+// Propagates the EOF of the peer to the connection. Connections that can not
+// be half-closed are closed.
+func (self *Client) closeWrite(point TunnelPoint) {
+	self.log.Trace("Client %s, received EOF from websocket", self.id)
+
+	halfCloser, ok := self.connection.(interface{ CloseWrite() error })
+
+	if !ok {
+		point.CloseClient(self.id)
+		return
+	}
+
+	err := halfCloser.CloseWrite()
+
+	if err != nil && !self.IsClosed() {
+		self.log.Error(err)
+		point.ResetClient(self.id, ErrorCodeOf(err), err)
+		return
+	}
+
+	if self.halfClose(false) {
+		point.CloseClient(self.id)
+	}
+}
+
+// Records datagram activity, that postpones the idle expiry.
+func (self *Client) touch() {
+	self.mutex.Lock()
+	self.lastActive = time.Now()
+	self.mutex.Unlock()
+}
+
+func (self *Client) activeSince() time.Time {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.lastActive
+}
+
+// Moves an opening client to open. Returns false if it was not opening, so
+// it is started once, or is still being connected.
+func (self *Client) start() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.state != ClientOpening || self.connection == nil {
+		return false
+	}
+
+	self.state = ClientOpen
+	return true
+}
+
+// Sets the connection of a client created while it was being dialed. The
+// connection is closed if the client was closed meanwhile.
+func (self *Client) connect(connection net.Conn) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.state == ClientClosed {
+		connection.Close()
+		return false
+	}
+
+	self.connection = connection
+	return true
+}
+
+// Marks a direction as done. Returns true once both are.
+func (self *Client) halfClose(read bool) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.state == ClientClosed {
+		return false
+	}
+
+	if read {
+		self.readDone = true
+	} else {
+		self.writeDone = true
+	}
+	self.state = ClientHalfClosed
+
+	return self.readDone && self.writeDone
+}
+
+// Queues data from the peer, without waiting, and returns the credit to
+// grant to the peer if any. Streams with flow control that send more than
+// their credit fail with ErrWindowExceeded. Past the queue limit datagrams
+// are dropped with ErrQueueFull and streams fail with ErrQueueOverflow,
+// whatever the policy.
+func (self *Client) Enqueue(data []byte) (int, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.state == ClientClosed {
+		return 0, errClientClosed
+	}
+
+	if self.windowed() && len(data) > self.peerWindow {
+		return 0, fmt.Errorf("%w by %d bytes", ErrWindowExceeded, len(data)-self.peerWindow)
+	}
+
+	if self.queued+len(data) > self.queueLimit {
+		if self.packet {
+			return 0, ErrQueueFull
+		}
+		return 0, ErrQueueOverflow
+	}
+
+	self.queue = append(self.queue, data)
+	self.queued += len(data)
+	self.cond.Broadcast()
+
+	if !self.windowed() {
+		return 0, nil
+	}
+
+	self.peerWindow -= len(data)
+
+	if self.resetOnOverflow {
+		return self.grant(len(data)), nil
+	}
+	return 0, nil
+}
+
+// Streams with flow control. Caller holds the mutex.
+func (self *Client) windowed() bool {
+	return self.flowControl && !self.packet
+}
+
+// Largest payload the client takes from the peer now. Bounds decompressed
+// payloads before they are queued.
+func (self *Client) room() int {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	switch {
+	case self.packet:
+		return maxDatagramSize
+	case self.flowControl:
+		return self.peerWindow
+	case self.queued < self.queueLimit:
+		return self.queueLimit - self.queued
+	default:
+		return 0
+	}
+}
+
+func (self *Client) dequeue() ([]byte, bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	for self.state != ClientClosed && len(self.queue) == 0 {
+		self.cond.Wait()
+	}
+
+	if self.state == ClientClosed {
+		return nil, false
+	}
+
+	data := self.queue[0]
+	self.queue[0] = nil
+	self.queue = self.queue[1:]
+
+	return data, true
+}
+
+// Accounts written bytes and returns the credit to grant to the peer, if
+// any.
+func (self *Client) consume(length int) int {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.queued -= length
+	self.cond.Broadcast()
+
+	if !self.windowed() || self.resetOnOverflow {
+		return 0
+	}
+	return self.grant(length)
+}
+
+// Accounts bytes the peer may send again and returns the credit, once it is
+// worth a window update. Caller holds the mutex.
+func (self *Client) grant(length int) int {
+	self.consumed += length
+
+	if self.consumed < initialWindow/4 {
+		return 0
+	}
+
+	credit := self.consumed + self.ungranted
+	self.consumed = 0
+	self.ungranted = 0
+	self.peerWindow += credit
+
+	return credit
+}
+
+// Adds credit granted by the peer.
+func (self *Client) GrantWindow(credit uint32) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.sendWindow += int(credit)
+	self.cond.Broadcast()
+}
+
+// Waits for credit to send data to the peer. Returns how many bytes, up to
+// max, can be read from the client, 0 if it was closed.
+func (self *Client) acquireWindow(max int) int {
+	if !self.flowControl {
+		return max
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	for self.state != ClientClosed && self.sendWindow <= 0 {
+		self.cond.Wait()
+	}
+
+	if self.state == ClientClosed {
+		return 0
+	}
+
+	if self.sendWindow < max {
+		return self.sendWindow
+	}
+	return max
+}
+
+func (self *Client) spendWindow(length int) {
+	if !self.flowControl {
+		return
+	}
+
+	self.mutex.Lock()
+	self.sendWindow -= length
+	self.mutex.Unlock()
+}
+
+// Closes the connection and wakes up everything waiting on the client.
+func (self *Client) Close() error {
+	self.cancel()
+
+	self.mutex.Lock()
+	self.state = ClientClosed
+	self.queue = nil
+	self.cond.Broadcast()
+	connection := self.connection
+	self.mutex.Unlock()
+
+	if connection == nil {
+		return nil
+	}
+	return connection.Close()
+}
+
+// Closes the connection abruptly, with a TCP RST.
+func (self *Client) Reset() error {
+	self.mutex.Lock()
+	connection := self.connection
+	self.mutex.Unlock()
+
+	if tcpConnection, ok := connection.(*net.TCPConn); ok {
+		tcpConnection.SetLinger(0)
+	}
+	return self.Close()
+}
+
+func (self *Client) State() ClientState {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.state
+}
+
+func (self *Client) IsClosed() bool {
+	return self.State() == ClientClosed
+}
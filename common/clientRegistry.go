@@ -0,0 +1,84 @@
+package common
+
+import (
+	"strconv"
+	"sync"
+)
+
+// Clients of a tunnel point by id. Safe for concurrent use, closed clients
+// are removed.
+type ClientRegistry struct {
+	mutex     sync.Mutex
+	clients   map[string]*Client
+	idCounter int
+}
+
+func NewClientRegistry() *ClientRegistry {
+	return &ClientRegistry{
+		clients:   make(map[string]*Client),
+		idCounter: 1,
+	}
+}
+
+// Allocates an id for a new client.
+func (self *ClientRegistry) NextId() string {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	//TODO: Make something more robust?
+	clientId := strconv.Itoa(self.idCounter)
+	self.idCounter++
+	return clientId
+}
+
+// Adds the client. Returns false if there is already a client with its id,
+// or it was closed.
+func (self *ClientRegistry) Add(client *Client) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if _, exists := self.clients[client.id]; exists || client.IsClosed() {
+		return false
+	}
+
+	self.clients[client.id] = client
+	return true
+}
+
+func (self *ClientRegistry) Get(clientId string) *Client {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.clients[clientId]
+}
+
+// Removes the client and returns it, or nil if it was not registered.
+func (self *ClientRegistry) Remove(clientId string) *Client {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	client := self.clients[clientId]
+	delete(self.clients, clientId)
+	return client
+}
+
+// Removes every client and returns them.
+func (self *ClientRegistry) RemoveAll() []*Client {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	clients := make([]*Client, 0, len(self.clients))
+	for _, client := range self.clients {
+		clients = append(clients, client)
+	}
+	self.clients = make(map[string]*Client)
+
+	return clients
+}
+
+func (self *ClientRegistry) Len() int {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return len(self.clients)
+}
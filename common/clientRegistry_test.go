@@ -0,0 +1,154 @@
+package common
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/alecthomas/log4go"
+)
+
+func newTestClient(t *testing.T, id string) (*Client, net.Conn) {
+	t.Helper()
+
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+
+	return NewClient(context.Background(), id, local, true, make(log4go.Logger)), remote
+}
+
+func TestClientRegistryNextId(t *testing.T) {
+	registry := NewClientRegistry()
+	ids := make(chan string, 16*100)
+
+	var group sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			for j := 0; j < 100; j++ {
+				ids <- registry.NextId()
+			}
+		}()
+	}
+	group.Wait()
+	close(ids)
+
+	seen := make(map[string]bool)
+	for id := range ids {
+		if seen[id] {
+			t.Fatalf("id %s allocated twice", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestClientRegistryAddGetRemove(t *testing.T) {
+	registry := NewClientRegistry()
+	client, _ := newTestClient(t, "1")
+
+	if !registry.Add(client) {
+		t.Fatal("Add failed")
+	}
+
+	duplicate, _ := newTestClient(t, "1")
+	if registry.Add(duplicate) {
+		t.Error("Add accepted a duplicate id")
+	}
+
+	if registry.Get("1") != client {
+		t.Error("Get did not return the client")
+	}
+	if registry.Get("2") != nil {
+		t.Error("Get returned an unknown client")
+	}
+
+	if registry.Remove("1") != client {
+		t.Error("Remove did not return the client")
+	}
+	if registry.Remove("1") != nil {
+		t.Error("Remove returned a client already removed")
+	}
+
+	if registry.Len() != 0 {
+		t.Errorf("Len %d after removing every client", registry.Len())
+	}
+}
+
+func TestClientRegistryRejectsClosed(t *testing.T) {
+	registry := NewClientRegistry()
+	client, _ := newTestClient(t, "1")
+	client.Close()
+
+	if registry.Add(client) {
+		t.Error("Add accepted a closed client")
+	}
+}
+
+func TestClientRegistryRemoveAll(t *testing.T) {
+	registry := NewClientRegistry()
+
+	for i := 0; i < 10; i++ {
+		client, _ := newTestClient(t, strconv.Itoa(i))
+		registry.Add(client)
+	}
+
+	if removed := registry.RemoveAll(); len(removed) != 10 {
+		t.Errorf("RemoveAll returned %d clients, expected 10", len(removed))
+	}
+
+	if registry.Len() != 0 || len(registry.RemoveAll()) != 0 {
+		t.Error("clients left after RemoveAll")
+	}
+}
+
+// Every client added is removed exactly once, by Remove or RemoveAll, however
+// they interleave.
+func TestClientRegistryConcurrent(t *testing.T) {
+	registry := NewClientRegistry()
+
+	var added, removed int64
+	var group sync.WaitGroup
+
+	for i := 0; i < 8; i++ {
+		group.Add(1)
+		go func() {
+			defer group.Done()
+
+			for j := 0; j < 200; j++ {
+				client, _ := newTestClient(t, registry.NextId())
+				if registry.Add(client) {
+					atomic.AddInt64(&added, 1)
+				}
+
+				registry.Get(client.id)
+
+				if j%2 == 0 {
+					if registry.Remove(client.id) != nil {
+						atomic.AddInt64(&removed, 1)
+					}
+					client.Close()
+				}
+
+				if j%50 == 0 {
+					atomic.AddInt64(&removed, int64(len(registry.RemoveAll())))
+				}
+
+				registry.Len()
+			}
+		}()
+	}
+	group.Wait()
+
+	removed += int64(len(registry.RemoveAll()))
+
+	if added != removed {
+		t.Errorf("%d clients added, %d removed", added, removed)
+	}
+}
@@ -0,0 +1,355 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/log4go"
+	"github.com/rsrdesarrollo/tunneler/messages"
+	"github.com/spf13/viper"
+)
+
+// Tunnel point that records what clients hand over, closing and resetting
+// them as entry and exit points do.
+type testPoint struct {
+	clients *ClientRegistry
+
+	mutex  sync.Mutex
+	data   bytes.Buffer
+	eofs   int
+	resets []string
+}
+
+func newTestPoint() *testPoint {
+	return &testPoint{clients: NewClientRegistry()}
+}
+
+func (self *testPoint) ReceiveDataFromClientSocket(client *Client, data []byte) {
+	self.mutex.Lock()
+	self.data.Write(data)
+	self.mutex.Unlock()
+
+	messages.PutBuffer(data)
+}
+
+func (self *testPoint) ReceiveEOFFromClientSocket(client *Client) {
+	self.mutex.Lock()
+	self.eofs++
+	self.mutex.Unlock()
+}
+
+func (self *testPoint) SendWindowUpdate(client *Client, credit uint32) {}
+
+func (self *testPoint) MaxPayloadSize() int {
+	return 16 * 1024
+}
+
+func (self *testPoint) CloseClient(clientId string) {
+	if client := self.clients.Remove(clientId); client != nil {
+		client.Close()
+	}
+}
+
+func (self *testPoint) ResetClient(clientId string, code string, err error) {
+	self.mutex.Lock()
+	self.resets = append(self.resets, code)
+	self.mutex.Unlock()
+
+	if client := self.clients.Remove(clientId); client != nil {
+		client.Reset()
+	}
+}
+
+func TestClientStates(t *testing.T) {
+	client, _ := newTestClient(t, "1")
+
+	if state := client.State(); state != ClientOpening {
+		t.Fatalf("new client %s, expected opening", state)
+	}
+
+	if !client.start() || client.State() != ClientOpen {
+		t.Fatalf("started client %s, expected open", client.State())
+	}
+	if client.start() {
+		t.Error("client started twice")
+	}
+
+	if client.halfClose(true) || client.State() != ClientHalfClosed {
+		t.Errorf("client %s after closing a direction, expected half-closed", client.State())
+	}
+	if !client.halfClose(false) {
+		t.Error("halfClose did not report both directions done")
+	}
+
+	client.Close()
+
+	if client.State() != ClientClosed || !client.IsClosed() {
+		t.Errorf("closed client %s", client.State())
+	}
+	if client.start() || client.halfClose(true) {
+		t.Error("closed client changed state")
+	}
+	if _, err := client.Enqueue([]byte("data")); err != errClientClosed {
+		t.Errorf("Enqueue on a closed client returned %v", err)
+	}
+}
+
+// Clients of legacy peers queue data while their connection is dialed.
+func TestClientConnectLater(t *testing.T) {
+	client := NewClient(context.Background(), "1", nil, false, make(log4go.Logger))
+
+	if client.start() {
+		t.Fatal("client started without a connection")
+	}
+	if _, err := client.Enqueue([]byte("early data")); err != nil {
+		t.Fatal(err)
+	}
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	if !client.connect(local) || !client.start() {
+		t.Fatalf("client %s once connected, expected open", client.State())
+	}
+	client.Close()
+
+	closed, _ := net.Pipe()
+	if client.connect(closed) {
+		t.Error("closed client took a connection")
+	}
+	if _, err := closed.Write([]byte("x")); err == nil {
+		t.Error("connection left open for a closed client")
+	}
+}
+
+// Closing a client still being dialed leaves nothing to close.
+func TestClientCloseWithoutConnection(t *testing.T) {
+	client := NewClient(context.Background(), "1", nil, false, make(log4go.Logger))
+
+	if err := client.Reset(); err != nil || client.State() != ClientClosed {
+		t.Errorf("client %s after Reset, %v", client.State(), err)
+	}
+}
+
+// Close, Reset and halfClose may race from the reader, the writer and the
+// session. Run with -race.
+func TestClientConcurrentClose(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		client, _ := newTestClient(t, "1")
+		client.start()
+
+		var group sync.WaitGroup
+		for _, step := range []func(){
+			func() { client.Close() },
+			func() { client.Reset() },
+			func() { client.halfClose(true) },
+			func() { client.halfClose(false) },
+			func() { client.Enqueue([]byte("data")) },
+			func() { client.dequeue() },
+			func() { client.acquireWindow(1024) },
+			func() { client.GrantWindow(1024) },
+			func() { client.State() },
+		} {
+			group.Add(1)
+			go func(step func()) {
+				defer group.Done()
+				step()
+			}(step)
+		}
+		group.Wait()
+
+		if client.State() != ClientClosed {
+			t.Fatalf("client %s after Close", client.State())
+		}
+	}
+}
+
+func TestClientCloseWakesWaiters(t *testing.T) {
+	client, _ := newTestClient(t, "1")
+	client.start()
+
+	client.mutex.Lock()
+	client.sendWindow = 0
+	client.mutex.Unlock()
+
+	done := make(chan struct{}, 2)
+
+	go func() {
+		if _, ok := client.dequeue(); ok {
+			t.Error("dequeue returned data from a closed client")
+		}
+		done <- struct{}{}
+	}()
+
+	go func() {
+		if size := client.acquireWindow(1024); size != 0 {
+			t.Errorf("acquireWindow returned %d bytes for a closed client", size)
+		}
+		done <- struct{}{}
+	}()
+
+	client.Close()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Close did not wake up the waiters")
+		}
+	}
+}
+
+// Data both ways, then the EOF of the peer closes the client.
+func TestClientHandlers(t *testing.T) {
+	viper.Set("ClientSocketBuffer", 4096)
+
+	point := newTestPoint()
+	client, remote := newTestClient(t, "1")
+	point.clients.Add(client)
+
+	if !client.start() {
+		t.Fatal("start failed")
+	}
+
+	var group sync.WaitGroup
+	group.Add(2)
+	go func() {
+		defer group.Done()
+		client.ClientHandler(point)
+	}()
+	go func() {
+		defer group.Done()
+		client.WriteHandler(point)
+	}()
+
+	if _, err := client.Enqueue([]byte("from peer")); err != nil {
+		t.Fatal(err)
+	}
+
+	received := make([]byte, len("from peer"))
+	if _, err := io.ReadFull(remote, received); err != nil || string(received) != "from peer" {
+		t.Fatalf("read %q, %v", received, err)
+	}
+
+	if _, err := remote.Write([]byte("to peer")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pipes can not be half-closed, the EOF of the peer closes the client
+	client.Enqueue(nil)
+	group.Wait()
+
+	if client.State() != ClientClosed || point.clients.Len() != 0 {
+		t.Errorf("client %s and %d registered after EOF", client.State(), point.clients.Len())
+	}
+
+	point.mutex.Lock()
+	defer point.mutex.Unlock()
+
+	if point.data.String() != "to peer" {
+		t.Errorf("point received %q", point.data.String())
+	}
+	if len(point.resets) != 0 {
+		t.Errorf("client reset with %v", point.resets)
+	}
+}
+
+// The queue never holds more than its limit, whatever the policy. Returns
+// right away, the session reader never waits.
+func TestClientQueueOverflow(t *testing.T) {
+	for _, test := range []struct {
+		name            string
+		flowControl     bool
+		packet          bool
+		resetOnOverflow bool
+		err             error
+	}{
+		{"block", true, false, false, ErrWindowExceeded},
+		{"reset", true, false, true, ErrQueueOverflow},
+		{"block without flow control", false, false, false, ErrQueueOverflow},
+		{"reset without flow control", false, false, true, ErrQueueOverflow},
+		{"datagrams", false, true, false, ErrQueueFull},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			client, _ := newTestClient(t, "1")
+			client.flowControl = test.flowControl
+			client.packet = test.packet
+			client.resetOnOverflow = test.resetOnOverflow
+
+			limit := client.queueLimit
+			if test.flowControl {
+				limit = initialWindow
+			}
+
+			if _, err := client.Enqueue(make([]byte, limit)); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := client.Enqueue(make([]byte, 1)); !errors.Is(err, test.err) {
+				t.Errorf("Enqueue over the limit returned %v, expected %v", err, test.err)
+			}
+
+			if client.queued > client.queueLimit {
+				t.Errorf("%d bytes queued, over the %d bytes limit", client.queued, client.queueLimit)
+			}
+		})
+	}
+}
+
+// With the block policy credit comes back as the writer catches up, the
+// peer never gets ahead of it.
+func TestClientBlockGrantsWrittenData(t *testing.T) {
+	client, _ := newTestClient(t, "1")
+
+	if credit, err := client.Enqueue(make([]byte, initialWindow)); err != nil || credit != 0 {
+		t.Fatalf("Enqueue granted %d bytes, %v", credit, err)
+	}
+
+	if room := client.room(); room != 0 {
+		t.Errorf("room for %d bytes with the window spent", room)
+	}
+
+	credit := client.consume(initialWindow)
+	if credit != client.windowSize {
+		t.Errorf("granted %d bytes once written, expected the %d bytes window", credit, client.windowSize)
+	}
+
+	if _, err := client.Enqueue(make([]byte, credit+1)); !errors.Is(err, ErrWindowExceeded) {
+		t.Errorf("Enqueue over the granted credit returned %v", err)
+	}
+}
+
+// With the reset policy credit comes back as data is queued, and the
+// connection is reset once the queue is full.
+func TestClientResetGrantsQueuedData(t *testing.T) {
+	client, _ := newTestClient(t, "1")
+	client.resetOnOverflow = true
+
+	for {
+		credit, err := client.Enqueue(make([]byte, client.room()))
+
+		if errors.Is(err, ErrQueueOverflow) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if credit == 0 {
+			t.Fatal("no credit granted for queued data")
+		}
+	}
+
+	if client.queued > client.queueLimit {
+		t.Errorf("%d bytes queued, over the %d bytes limit", client.queued, client.queueLimit)
+	}
+
+	if credit := client.consume(client.queued); credit != 0 {
+		t.Errorf("granted %d bytes again once written", credit)
+	}
+}
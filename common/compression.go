@@ -0,0 +1,174 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/rsrdesarrollo/tunneler/messages"
+)
+
+const (
+	// Payloads shorter than this are sent as they are
+	minCompressSize = 64
+	// Ceiling of the decoder, payloads are bounded by what the client takes
+	maxDecompressedSize = 16 << 20
+)
+
+// A compressed payload decompresses to more than the client takes
+var ErrPayloadTooLarge = errors.New("decompressed payload too large")
+
+// Encoder and decoder are safe for concurrent use, so every tunnel shares them.
+var zstdCodec = struct {
+	once    sync.Once
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+}{}
+
+func zstdCoders() (*zstd.Encoder, *zstd.Decoder) {
+	zstdCodec.once.Do(func() {
+		zstdCodec.encoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+		zstdCodec.decoder, _ = zstd.NewReader(nil,
+			zstd.WithDecoderMaxMemory(maxDecompressedSize),
+			zstd.WithDecodeAllCapLimit(true),
+		)
+	})
+	return zstdCodec.encoder, zstdCodec.decoder
+}
+
+// Parses a compression name from the configuration or a tunnel spec.
+func ParseCompression(name string) (string, error) {
+	switch name {
+	case "", "none":
+		return messages.Compression.None, nil
+	case messages.Compression.Zstd:
+		return messages.Compression.Zstd, nil
+	default:
+		return "", fmt.Errorf("unsupported compression %q", name)
+	}
+}
+
+// Compresses the Data payloads a tunnel sends, decompresses the ones it
+// receives, and counts the bytes before and after.
+type payloadCompression struct {
+	name string
+
+	rawSent      atomic.Uint64
+	wireSent     atomic.Uint64
+	rawReceived  atomic.Uint64
+	wireReceived atomic.Uint64
+}
+
+func newPayloadCompression(name string) (*payloadCompression, error) {
+	name, err := ParseCompression(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &payloadCompression{name: name}, nil
+}
+
+// Builds the Data message of a pooled payload, compressed if worth it. The
+// message owns whichever pooled buffer it carries.
+func (self *payloadCompression) DataMessage(tunnelId string, clientId string, data []byte) *messages.Message {
+	self.rawSent.Add(uint64(len(data)))
+
+	if self.name == messages.Compression.Zstd && len(data) >= minCompressSize {
+		encoder, _ := zstdCoders()
+		compressed := encoder.EncodeAll(data, messages.GetBuffer(len(data))[:0])
+
+		if len(compressed) < len(data) {
+			messages.PutBuffer(data)
+
+			msg := messages.PooledDataMessage(tunnelId, clientId, compressed)
+			msg.Compression = self.name
+			self.wireSent.Add(uint64(len(compressed)))
+			return msg
+		}
+
+		messages.PutBuffer(compressed)
+	}
+
+	self.wireSent.Add(uint64(len(data)))
+
+	return messages.PooledDataMessage(tunnelId, clientId, data)
+}
+
+// Payload of a received Data message, decompressed up to limit bytes. The
+// peer may send any payload uncompressed.
+func (self *payloadCompression) Payload(msg *messages.Message, limit int) ([]byte, error) {
+	data := msg.Data
+
+	switch msg.Compression {
+	case messages.Compression.None:
+	case messages.Compression.Zstd:
+		var err error
+		data, err = zstdDecompress(msg.Data, limit)
+
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", msg.Compression)
+	}
+
+	self.rawReceived.Add(uint64(len(data)))
+	self.wireReceived.Add(uint64(len(msg.Data)))
+
+	return data, nil
+}
+
+// Reset code of a payload that could not be decompressed.
+func payloadErrorCode(err error) string {
+	if errors.Is(err, ErrPayloadTooLarge) {
+		return messages.ErrorCode.TooLarge
+	}
+	return messages.ErrorCode.Internal
+}
+
+// Decodes into a buffer of the declared size, or of limit bytes if the frame
+// does not declare it. The decoder fails past its capacity.
+func zstdDecompress(data []byte, limit int) ([]byte, error) {
+	var header zstd.Header
+
+	if err := header.Decode(data); err != nil {
+		return nil, fmt.Errorf("invalid zstd payload: %s", err)
+	}
+
+	size := limit
+	if header.HasFCS && header.FrameContentSize <= uint64(limit) {
+		size = int(header.FrameContentSize)
+	}
+
+	_, decoder := zstdCoders()
+	decoded, err := decoder.DecodeAll(data, make([]byte, 0, size))
+
+	if errors.Is(err, zstd.ErrDecoderSizeExceeded) {
+		return nil, fmt.Errorf("%w, over the %d bytes left", ErrPayloadTooLarge, limit)
+	} else if err != nil {
+		return nil, fmt.Errorf("invalid zstd payload: %s", err)
+	}
+
+	return decoded, nil
+}
+
+func (self *payloadCompression) Stats(tunnelId string) TunnelStats {
+	stats := TunnelStats{
+		Id:           tunnelId,
+		Compression:  self.name,
+		RawSent:      self.rawSent.Load(),
+		WireSent:     self.wireSent.Load(),
+		RawReceived:  self.rawReceived.Load(),
+		WireReceived: self.wireReceived.Load(),
+	}
+
+	stats.CompressionRatio = 1
+	if wire := stats.WireSent + stats.WireReceived; wire > 0 {
+		stats.CompressionRatio = float64(stats.RawSent+stats.RawReceived) / float64(wire)
+	}
+
+	return stats
+}
@@ -0,0 +1,76 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/rsrdesarrollo/tunneler/messages"
+)
+
+func compressedMessage(t *testing.T, data []byte) *messages.Message {
+	t.Helper()
+
+	compression, err := newPayloadCompression(messages.Compression.Zstd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := messages.GetBuffer(len(data))
+	copy(payload, data)
+
+	msg := compression.DataMessage("1", "2", payload)
+	if msg.Compression != messages.Compression.Zstd {
+		t.Fatal("payload sent uncompressed")
+	}
+	return msg
+}
+
+func TestPayloadWithinLimit(t *testing.T) {
+	data := bytes.Repeat([]byte("tunneler "), 1000)
+	msg := compressedMessage(t, data)
+
+	compression, _ := newPayloadCompression(messages.Compression.Zstd)
+	payload, err := compression.Payload(msg, len(data))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(payload, data) {
+		t.Error("payload differs from the data sent")
+	}
+}
+
+func TestPayloadOverLimit(t *testing.T) {
+	data := bytes.Repeat([]byte("tunneler "), 1000)
+	msg := compressedMessage(t, data)
+
+	compression, _ := newPayloadCompression(messages.Compression.Zstd)
+
+	if _, err := compression.Payload(msg, len(data)-1); !errors.Is(err, ErrPayloadTooLarge) {
+		t.Errorf("Payload over the limit returned %v", err)
+	}
+}
+
+// Frames that do not declare their size stop decoding at the limit.
+func TestPayloadOverLimitWithoutContentSize(t *testing.T) {
+	var compressed bytes.Buffer
+
+	encoder, err := zstd.NewWriter(&compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoder.Write(make([]byte, 4<<20))
+	encoder.Close()
+
+	msg := messages.DataMessage("1", "2", compressed.Bytes())
+	msg.Compression = messages.Compression.Zstd
+
+	compression, _ := newPayloadCompression(messages.Compression.Zstd)
+	payload, err := compression.Payload(msg, initialWindow)
+
+	if !errors.Is(err, ErrPayloadTooLarge) {
+		t.Errorf("Payload of %d bytes over the limit returned %v", len(payload), err)
+	}
+}
@@ -0,0 +1,258 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/spf13/viper"
+)
+
+var ErrPolicyDenied = errors.New("destination denied by policy")
+
+// Destinations exit points may dial. Deny rules win, and once there is any
+// allow rule everything else is denied.
+//
+// Rules are a target with an optional port or port range, for example
+// 10.0.0.0/8, 192.168.1.10:22, *.internal.example.com:8000-8999, [::1]:22 or
+// *:443. Targets are CIDRs and IPs, checked against the address dialed after
+// DNS resolution, or host names with * wildcards, checked against the name
+// the tunnel asked for.
+type DestinationPolicy struct {
+	allow []destinationRule
+	deny  []destinationRule
+	// Checked first, on policies narrowed down from it
+	parent *DestinationPolicy
+}
+
+type destinationRule struct {
+	// Any of them, or any target if both are empty
+	network *net.IPNet
+	host    string
+	minPort int
+	maxPort int
+}
+
+// Policy from AllowDestinations and DenyDestinations.
+func DestinationPolicyConfig() (*DestinationPolicy, error) {
+	allow, err := parseDestinationRules(viper.GetStringSlice("AllowDestinations"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid AllowDestinations: %s", err)
+	}
+
+	deny, err := parseDestinationRules(viper.GetStringSlice("DenyDestinations"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid DenyDestinations: %s", err)
+	}
+
+	return &DestinationPolicy{allow: allow, deny: deny}, nil
+}
+
+// A policy that only allows what both this one and the allow rules do.
+func (self *DestinationPolicy) Narrow(allow []string) (*DestinationPolicy, error) {
+	rules, err := parseDestinationRules(allow)
+	if err != nil || len(rules) == 0 {
+		return self, err
+	}
+
+	return &DestinationPolicy{allow: rules, parent: self}, nil
+}
+
+func parseDestinationRules(specs []string) ([]destinationRule, error) {
+	rules := make([]destinationRule, 0, len(specs))
+
+	for _, spec := range specs {
+		rule, err := parseDestinationRule(strings.TrimSpace(spec))
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+func parseDestinationRule(spec string) (destinationRule, error) {
+	rule := destinationRule{minPort: 0, maxPort: 65535}
+	target, ports := spec, ""
+
+	// IPv6 targets need brackets to take a port
+	if strings.HasPrefix(spec, "[") {
+		end := strings.Index(spec, "]")
+		if end < 0 {
+			return rule, fmt.Errorf("%q: missing ]", spec)
+		}
+		target, ports = spec[1:end], strings.TrimPrefix(spec[end+1:], ":")
+	} else if strings.Count(spec, ":") == 1 {
+		target, ports, _ = strings.Cut(spec, ":")
+	}
+
+	if ports != "" && ports != "*" {
+		var err error
+		rule.minPort, rule.maxPort, err = parsePortRange(ports)
+		if err != nil {
+			return rule, fmt.Errorf("%q: %s", spec, err)
+		}
+	}
+
+	switch {
+	case target == "" || target == "*":
+	case strings.Contains(target, "/"):
+		_, network, err := net.ParseCIDR(target)
+		if err != nil {
+			return rule, fmt.Errorf("%q: %s", spec, err)
+		}
+		rule.network = network
+	case net.ParseIP(target) != nil:
+		rule.network = hostNetwork(net.ParseIP(target))
+	default:
+		if _, err := path.Match(target, ""); err != nil {
+			return rule, fmt.Errorf("%q: %s", spec, err)
+		}
+		rule.host = strings.ToLower(target)
+	}
+
+	return rule, nil
+}
+
+// Network of a single IP.
+func hostNetwork(ip net.IP) *net.IPNet {
+	if ip.To4() != nil {
+		return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// Parses a port, or a range of them as 8000-8999.
+func parsePortRange(ports string) (int, int, error) {
+	first, last, isRange := strings.Cut(ports, "-")
+	if !isRange {
+		last = first
+	}
+
+	min, err := strconv.Atoi(first)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port %q", first)
+	}
+
+	max, err := strconv.Atoi(last)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port %q", last)
+	}
+
+	if min < 0 || max > 65535 || min > max {
+		return 0, 0, fmt.Errorf("invalid port range %q", ports)
+	}
+
+	return min, max, nil
+}
+
+// Whether the rule matches host, ip or both. Either can be unknown.
+func (self destinationRule) matches(host string, ip net.IP, port int) bool {
+	if port < self.minPort || port > self.maxPort {
+		return false
+	}
+
+	switch {
+	case self.network != nil:
+		return ip != nil && self.network.Contains(ip)
+	case self.host != "":
+		matched, _ := path.Match(self.host, strings.ToLower(host))
+		return host != "" && matched
+	default:
+		return true
+	}
+}
+
+func matchesAny(rules []destinationRule, host string, ip net.IP, port int) bool {
+	for _, rule := range rules {
+		if rule.matches(host, ip, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether any rule matches host, or may match it once resolved.
+func mayMatchAny(rules []destinationRule, host string, port int) bool {
+	for _, rule := range rules {
+		unresolved := rule.network != nil && port >= rule.minPort && port <= rule.maxPort
+		if unresolved || rule.matches(host, nil, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks the address dialed for host, once resolved to ip. A nil policy
+// allows everything.
+func (self *DestinationPolicy) check(host string, ip net.IP, port int) error {
+	if self == nil {
+		return nil
+	}
+
+	if err := self.parent.check(host, ip, port); err != nil {
+		return err
+	}
+
+	if matchesAny(self.deny, host, ip, port) || (len(self.allow) > 0 && !matchesAny(self.allow, host, ip, port)) {
+		return fmt.Errorf("%w: %s", ErrPolicyDenied, net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+	}
+	return nil
+}
+
+// Checks what is known of a service before resolving it. Services named by
+// host are checked against IP rules once dialed.
+func (self *DestinationPolicy) CheckService(service string) error {
+	if self == nil {
+		return nil
+	}
+
+	host, portName, err := net.SplitHostPort(service)
+	if err != nil {
+		return err
+	}
+
+	port, err := strconv.Atoi(portName)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", portName)
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return self.check("", ip, port)
+	}
+
+	if err := self.parent.CheckService(service); err != nil {
+		return err
+	}
+
+	if matchesAny(self.deny, host, nil, port) || (len(self.allow) > 0 && !mayMatchAny(self.allow, host, port)) {
+		return fmt.Errorf("%w: %s", ErrPolicyDenied, service)
+	}
+	return nil
+}
+
+// Dialer that checks every address it connects to for service, after DNS
+// resolution.
+func (self *DestinationPolicy) dialer(service string) net.Dialer {
+	host, _, _ := net.SplitHostPort(service)
+	if net.ParseIP(host) != nil {
+		host = ""
+	}
+
+	return net.Dialer{
+		Control: func(network string, address string, _ syscall.RawConn) error {
+			ipName, portName, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+
+			port, _ := strconv.Atoi(portName)
+			return self.check(host, net.ParseIP(ipName), port)
+		},
+	}
+}
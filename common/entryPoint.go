@@ -1,66 +1,126 @@
 package common
 
 import (
-	"encoding/json"
-	"github.com/alecthomas/log4go"
-	"github.com/gorilla/websocket"
-	"github.com/rsrdesarrollo/tunneler/messages"
+	"errors"
+	"fmt"
 	"net"
-	"strconv"
 	"sync"
+	"syscall"
+
+	"github.com/alecthomas/log4go"
+	"github.com/rsrdesarrollo/tunneler/messages"
+	"github.com/spf13/viper"
 )
 
 type EntryPoint struct {
-	Websocket               *websocket.Conn
-	Clients                 map[string]*Client
-	Service                 string
-	Protocol                string
-	WebsocketWritterChannel chan *messages.Message
-	WebsocketReaderChannel  chan *messages.Message
-	Listener                net.Listener
-	Done                    chan bool
-
-	mutex  sync.Mutex
-	isOpen bool
-	log    log4go.Logger
+	Session        *Session
+	TunnelId       string
+	Clients        *ClientRegistry
+	Service        string
+	Protocol       string
+	Listener       net.Listener
+	PacketListener net.PacketConn
+
+	mutex       sync.Mutex
+	supervisor  *supervisor
+	compression *payloadCompression
+	fragments   *reassembler
+	priority    string
+	log         log4go.Logger
+	udpPeers    map[string]string
 }
 
-func NewEntryPoint(wsocket *websocket.Conn, protocol string, service string, log log4go.Logger) (*EntryPoint, error) {
+func NewEntryPoint(session *Session, tunnelId string, protocol string, service string, options TunnelOptions, log log4go.Logger) (*EntryPoint, error) {
+	compression, err := newPayloadCompression(options.Compression)
+
+	if err != nil {
+		return nil, err
+	}
+
+	priority, err := ParsePriority(options.Priority)
+
+	if err != nil {
+		return nil, err
+	}
 
-	// TODO: implement UDP (might change a lot of things)
-	listener, err := net.Listen(protocol, service)
+	service, err = options.Binds.Check(session.Context(), service)
 
 	if err != nil {
 		return nil, err
 	}
 
 	obj := &EntryPoint{
-		Websocket:               wsocket,
-		Clients:                 make(map[string]*Client),
-		Service:                 service,
-		Protocol:                protocol,
-		WebsocketReaderChannel:  make(chan *messages.Message, 10),
-		WebsocketWritterChannel: make(chan *messages.Message, 10),
-		Listener:                listener,
-		Done:                    make(chan bool, 1),
+		Session:  session,
+		TunnelId: tunnelId,
+		Clients:  NewClientRegistry(),
+		Service:  service,
+		Protocol: protocol,
+
+		mutex:       sync.Mutex{},
+		supervisor:  newSupervisor(session.Context()),
+		compression: compression,
+		fragments:   newReassembler(),
+		priority:    priority,
+		log:         log,
+		udpPeers:    make(map[string]string),
+	}
 
-		mutex:  sync.Mutex{},
-		isOpen: true,
-		log:    log,
+	err = obj.listen(options.Binds)
+
+	if err != nil {
+		obj.supervisor.Stop()
+		return nil, err
 	}
 
-	obj.log.Info("Entry point binded on %s", service)
+	obj.log.Info("Tunnel %s, entry point binded on %s://%s", tunnelId, protocol, obj.Service)
+
+	obj.supervisor.Start(obj.shutdown, obj.finished)
 
-	//Connection handler loop
-	go obj.ConnectionHandler()
-	// Reader Loop
-	go obj.WebsocketReader()
-	// Writer Loop
-	go obj.WebsocketWriter()
+	if obj.PacketListener != nil {
+		// Datagram demultiplexer loop
+		obj.supervisor.Go(obj.PacketHandler)
+	} else {
+		//Connection handler loop
+		obj.supervisor.Go(obj.ConnectionHandler)
+	}
 
 	return obj, nil
 }
 
+var errNoDynamicPort = fmt.Errorf("%w: no free dynamic port", ErrBindDenied)
+
+// Listens on Service, trying the ports the bind policy has for port 0.
+// Service becomes the address bound.
+func (self *EntryPoint) listen(binds *BindPolicy) error {
+	err := errNoDynamicPort
+
+	tried := binds.tryCandidates(self.Service, func(service string) bool {
+		if isPacketProtocol(self.Protocol) {
+			self.PacketListener, err = net.ListenPacket(self.Protocol, service)
+		} else {
+			self.Listener, err = net.Listen(self.Protocol, service)
+		}
+
+		return errors.Is(err, syscall.EADDRINUSE)
+	})
+
+	if errors.Is(err, syscall.EADDRINUSE) && tried > 1 {
+		err = errNoDynamicPort
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if self.PacketListener != nil {
+		self.Service = self.PacketListener.LocalAddr().String()
+	} else {
+		self.Service = self.Listener.Addr().String()
+	}
+
+	return nil
+}
+
 func (self *EntryPoint) ReceiveDataFromWebsocket(client *Client, data []byte) {
 	self.log.Debug("ReceiveDataFromWebsocket")
 
@@ -71,134 +131,324 @@ func (self *EntryPoint) ReceiveDataFromWebsocket(client *Client, data []byte) {
 
 	self.log.Debug("client: %s, data: %s", client.id, data)
 
-	writeLen, err := client.connection.Write(data)
+	credit, err := client.Enqueue(data)
+
+	if errors.Is(err, ErrWindowExceeded) {
+		self.log.Warn("Client %s, %s. Resetting it", client.id, err)
+		self.ResetClient(client.id, messages.ErrorCode.FlowControl, err)
+	} else if errors.Is(err, ErrQueueOverflow) {
+		self.log.Warn("Client %s, %s. Resetting it", client.id, err)
+		self.ResetClient(client.id, messages.ErrorCode.Overflow, err)
+	} else if errors.Is(err, ErrQueueFull) {
+		self.log.Warn("Client %s, queue full, dropping %d bytes", client.id, len(data))
+	} else if credit > 0 {
+		self.SendWindowUpdate(client, uint32(credit))
+	}
+}
 
-	self.log.Trace("Client %s, write %d bytes", client.id, writeLen)
+func (self *EntryPoint) ReceiveDataFromClientSocket(client *Client, data []byte) {
+	msg := self.compression.DataMessage(self.TunnelId, client.id, data)
 
-	if err != nil {
-		//TODO handle error but not EOF
-		self.log.Error(err)
-		self.CloseClient(client.id)
+	// Datagrams may not fit a frame of the peer, stream reads always do
+	for _, part := range msg.Fragment(self.Session.MaxPayloadSize()) {
+		self.Session.Send(part)
 	}
 }
 
-func (self *EntryPoint) ReceiveDataFromClientSocket(client *Client, data []byte) {
-	self.WebsocketWritterChannel <- messages.DataMessage(
+func (self *EntryPoint) MaxPayloadSize() int {
+	return self.Session.MaxPayloadSize()
+}
+
+func (self *EntryPoint) SendWindowUpdate(client *Client, credit uint32) {
+	self.Session.Send(messages.WindowUpdateMessage(
+		self.TunnelId,
 		client.id,
-		data,
-	)
+		credit,
+	))
 }
 
-func (self *EntryPoint) WebsocketWriter() {
-	self.log.Debug("WebsocketWriter")
-	var msg *messages.Message
-	for self.isOpen {
-		msg = <-self.WebsocketWritterChannel
+func (self *EntryPoint) ReceiveEOFFromClientSocket(client *Client) {
+	if self.Session.HasFeature(messages.Feature.Streams) {
+		self.Session.Send(messages.CloseMessage(self.TunnelId, client.id))
+	} else {
+		// Legacy peers take an empty payload as EOF
+		self.Session.Send(messages.DataMessage(self.TunnelId, client.id, nil))
+	}
+}
 
-		msgJson, _ := json.Marshal(msg)
-		self.log.Trace("Writting message to websocket %s", msgJson)
+func (self *EntryPoint) ReceiveMessageFromWebsocket(msg *messages.Message) {
+	client := self.Clients.Get(msg.ClientId)
 
-		err := self.Websocket.WriteJSON(msg)
-		if err != nil {
-			self.TerminateChannel(err)
-			break // TODO: call entrypoint terminate
+	if client == nil {
+		if len(msg.Data) > 0 {
+			self.log.Warn("Receiving data from unexsiten or closed client.")
 		}
+		return
 	}
-}
 
-func (self *EntryPoint) WebsocketReader() {
-	self.log.Debug("WebsocketReader")
+	switch msg.Type {
+	case messages.MessageType.OpenAck:
+		self.log.Debug("Client %s, connected by the exit point", msg.ClientId)
+		self.startClient(client)
+
+	case messages.MessageType.Reset:
+		self.log.Info("Client %s, reset by peer: %s (%s)", msg.ClientId, msg.Code, msg.Description)
+		if client = self.removeClient(msg.ClientId); client != nil {
+			client.Reset()
+		}
+
+	case messages.MessageType.WindowUpdate:
+		client.GrantWindow(msg.Window)
 
-	for self.isOpen {
-		msg := messages.New()
+	case messages.MessageType.Close:
+		// Queued so the EOF is handled after pending data is written
+		client.Enqueue(nil)
 
-		err := self.Websocket.ReadJSON(msg)
+	default:
+		if len(msg.Data) == 0 {
+			client.Enqueue(nil)
+			return
+		}
+
+		whole, err := self.fragments.add(msg)
 
 		if err != nil {
-			self.TerminateChannel(err)
-			break // TODO: call entrypoint terminate
+			self.log.Error(err)
+			self.ResetClient(msg.ClientId, messages.ErrorCode.TooLarge, err)
+			return
 		}
 
-		msgJson, _ := json.Marshal(msg)
-		self.log.Trace("Readed message from websocket %s", msgJson)
-
-		if msg.Type == messages.MessageType.Data {
-			client := self.Clients[msg.ClientId]
-			if len(msg.Data) == 0 {
-				if client.readyToClose {
-					self.log.Trace("Client %s, received EOF from websocket", msg.ClientId)
-					self.CloseClient(msg.ClientId)
-					continue
-				} else {
-					client.readyToClose = true
-					continue
-				}
-			}
-			self.ReceiveDataFromWebsocket(client, msg.Data)
-		} else {
-			self.WebsocketReaderChannel <- msg
+		if whole == nil {
+			return
 		}
+
+		data, err := self.compression.Payload(whole, client.room())
+
+		if err != nil {
+			self.log.Error(err)
+			self.ResetClient(msg.ClientId, payloadErrorCode(err), err)
+			return
+		}
+
+		self.ReceiveDataFromWebsocket(client, data)
 	}
 }
 
-func (self *EntryPoint) ConnectionHandler() {
+func (self *EntryPoint) ConnectionHandler() error {
 	self.log.Debug("ConnectionHandler")
-	var clientIdGenerator = 1 //TODO: Make something more robust?
-	for self.isOpen {
+	for {
 		connection, err := self.Listener.Accept()
 
 		if err != nil {
-			self.TerminateChannel(err)
-			break // TODO: call entrypoint terminate
+			if !self.IsOpen() {
+				return nil
+			}
+			return err
 		}
 
-		self.mutex.Lock()
-
-		clientId := strconv.Itoa(clientIdGenerator)
-		clientIdGenerator++
+		clientId := self.Clients.NextId()
 
 		self.log.Info("New client [%s] from %s", clientId, connection.RemoteAddr().String())
 
-		self.Clients[clientId] = NewClient(
+		client := NewClient(
+			self.supervisor.ctx,
 			clientId,
 			connection,
+			self.Session.HasFeature(messages.Feature.Flow),
 			self.log,
 		)
 
+		if !self.addClient(client) {
+			client.Close()
+			return nil
+		}
+
+		self.openClient(client)
+	}
+}
+
+// Peers with streams get an Open and the client is handled once the exit
+// point acknowledges it. Legacy peers connect on the first data.
+func (self *EntryPoint) openClient(client *Client) {
+	if self.Session.HasFeature(messages.Feature.Streams) {
+		self.Session.Send(messages.OpenMessage(self.TunnelId, client.id))
+		return
+	}
+
+	self.startClient(client)
+}
+
+// Opens the client and handles its read and write data on the tunnel
+// supervisor. Clients already started are left as they are.
+func (self *EntryPoint) startClient(client *Client) {
+	if !client.start() {
+		return
+	}
+
+	started := self.supervisor.Go(func() error {
+		client.ClientHandler(self)
+		return nil
+	}) && self.supervisor.Go(func() error {
+		client.WriteHandler(self)
+		return nil
+	})
+
+	if !started {
+		client.Close()
+	}
+}
+
+// Every datagram peer gets its own session, identified by its source address,
+// that lives until it is idle for UdpIdleTimeout.
+func (self *EntryPoint) PacketHandler() error {
+	self.log.Debug("PacketHandler")
+
+	idleTimeout := viper.GetDuration("UdpIdleTimeout")
+	buffer := make([]byte, maxDatagramSize)
+
+	for {
+		readLen, peer, err := self.PacketListener.ReadFrom(buffer)
+
+		if err != nil {
+			if !self.IsOpen() {
+				return nil
+			}
+			return err
+		}
+
+		datagram := messages.GetBuffer(readLen)
+		copy(datagram, buffer[:readLen])
+
+		self.mutex.Lock()
+
+		if !self.IsOpen() {
+			self.mutex.Unlock()
+			return nil
+		}
+
+		client := self.Clients.Get(self.udpPeers[peer.String()])
+		isNew := client == nil
+		if isNew {
+			clientId := self.Clients.NextId()
+
+			self.log.Info("New udp session [%s] from %s", clientId, peer.String())
+
+			client = NewPacketClient(
+				self.supervisor.ctx,
+				clientId,
+				NewUdpSession(self.PacketListener, peer),
+				idleTimeout,
+				self.log,
+			)
+			self.Clients.Add(client)
+			self.udpPeers[peer.String()] = clientId
+		}
+
 		self.mutex.Unlock()
 
-		// Handle client read data
-		go self.Clients[clientId].ClientHandler(self)
+		if isNew {
+			self.openClient(client)
+		}
+
+		if !client.connection.(*UdpSession).Deliver(datagram) {
+			messages.PutBuffer(datagram)
+			self.log.Warn("Udp session [%s] queue full, dropping %d bytes", client.id, readLen)
+		}
 	}
 }
 
 func (self *EntryPoint) CloseClient(clientId string) {
+	if client := self.removeClient(clientId); client != nil {
+		client.Close()
+	}
+}
+
+func (self *EntryPoint) ResetClient(clientId string, code string, err error) {
+	client := self.removeClient(clientId)
 
-	client := self.Clients[clientId]
-	self.Clients[clientId] = nil
+	if client == nil {
+		return
+	}
 
-	if client != nil {
-		client.connection.Close()
+	if self.Session.HasFeature(messages.Feature.Streams) {
+		self.Session.Send(messages.ResetMessage(self.TunnelId, clientId, code, err))
+	} else {
+		self.Session.Send(messages.DataMessage(self.TunnelId, clientId, nil))
 	}
+
+	client.Reset()
+}
+
+// Registers the client unless the tunnel was closed meanwhile.
+func (self *EntryPoint) addClient(client *Client) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.IsOpen() && self.Clients.Add(client)
 }
 
+func (self *EntryPoint) removeClient(clientId string) *Client {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.fragments.forget(clientId)
+	client := self.Clients.Remove(clientId)
+
+	if client != nil && client.packet {
+		delete(self.udpPeers, client.connection.RemoteAddr().String())
+	}
+
+	return client
+}
+
+// Stops the tunnel. Every goroutine of it returns shortly after.
 func (self *EntryPoint) CloseChannel() {
-	self.isOpen = false
+	self.log.Debug("CloseChannel")
+	self.supervisor.Stop()
+}
+
+// Releases the listener and clients once the tunnel is stopping.
+func (self *EntryPoint) shutdown() {
+	if self.Listener != nil {
+		self.Listener.Close()
+	}
+	if self.PacketListener != nil {
+		self.PacketListener.Close()
+	}
+
+	self.mutex.Lock()
+	clients := self.Clients.RemoveAll()
+	self.udpPeers = make(map[string]string)
+	self.mutex.Unlock()
 
-	for clientId, _ := range self.Clients {
-		self.CloseClient(clientId)
+	for _, client := range clients {
+		client.Close()
 	}
+}
+
+func (self *EntryPoint) finished(err error) {
+	if err != nil {
+		self.log.Critical(err)
+	}
+	self.Session.TunnelClosed(self.TunnelId)
+}
+
+// Waits until every goroutine of the tunnel returned. Returns the error that
+// caused the tunnel to close, if any.
+func (self *EntryPoint) Wait() error {
+	return self.supervisor.Wait()
+}
 
-	self.Done <- true
+func (self *EntryPoint) Priority() string {
+	return self.priority
 }
 
-func (self *EntryPoint) TerminateChannel(error error) {
-	self.log.Critical(error)
-	self.Listener.Close()
-	self.CloseChannel()
-	self.Websocket.Close()
+func (self *EntryPoint) Stats() TunnelStats {
+	stats := self.compression.Stats(self.TunnelId)
+	stats.Priority = self.priority
+	return stats
 }
 
 func (self *EntryPoint) IsOpen() bool {
-	return self.isOpen
+	return self.supervisor.IsRunning()
 }
@@ -0,0 +1,31 @@
+package common
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	"github.com/rsrdesarrollo/tunneler/messages"
+)
+
+// Maps a dial or socket error to the code sent on Reset.
+func ErrorCodeOf(err error) string {
+	var dnsError *net.DNSError
+
+	switch {
+	case errors.Is(err, ErrPolicyDenied):
+		return messages.ErrorCode.PolicyDenied
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return messages.ErrorCode.Refused
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return messages.ErrorCode.Reset
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH), errors.As(err, &dnsError):
+		return messages.ErrorCode.Unreachable
+	}
+
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return messages.ErrorCode.Timeout
+	}
+
+	return messages.ErrorCode.Internal
+}
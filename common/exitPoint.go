@@ -1,179 +1,416 @@
 package common
 
 import (
-	"encoding/json"
-	"github.com/alecthomas/log4go"
-	"github.com/gorilla/websocket"
-	"github.com/rsrdesarrollo/tunneler/messages"
+	"context"
+	"errors"
+	"fmt"
 	"net"
 	"sync"
 	"time"
+
+	"github.com/alecthomas/log4go"
+	"github.com/rsrdesarrollo/tunneler/messages"
+	"github.com/spf13/viper"
 )
 
 type ExitPoint struct {
-	Websocket               *websocket.Conn
-	Clients                 map[string]*Client
-	Service                 string
-	Protocol                string
-	WebsocketWritterChannel chan *messages.Message
-	WebsocketReaderChannel  chan *messages.Message
-	Done                    chan bool
-
-	mutex  sync.Mutex
-	isOpen bool
-	log    log4go.Logger
+	Session  *Session
+	TunnelId string
+	Clients  *ClientRegistry
+	Service  string
+	Protocol string
+
+	mutex        sync.Mutex
+	supervisor   *supervisor
+	compression  *payloadCompression
+	fragments    *reassembler
+	priority     string
+	destinations *DestinationPolicy
+	log          log4go.Logger
 }
 
-func NewExitPoint(wsocket *websocket.Conn, protocol string, service string, log log4go.Logger) (*ExitPoint, error) {
+func NewExitPoint(session *Session, tunnelId string, protocol string, service string, options TunnelOptions, log log4go.Logger) (*ExitPoint, error) {
+	compression, err := newPayloadCompression(options.Compression)
 
-	obj := &ExitPoint{
-		Websocket:               wsocket,
-		Clients:                 make(map[string]*Client),
-		Service:                 service,
-		Protocol:                protocol,
-		WebsocketWritterChannel: make(chan *messages.Message, 10),
-		WebsocketReaderChannel:  make(chan *messages.Message, 10),
+	if err != nil {
+		return nil, err
+	}
+
+	priority, err := ParsePriority(options.Priority)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = options.Destinations.CheckService(service)
 
-		Done: make(chan bool, 1),
+	if err != nil {
+		return nil, err
+	}
 
-		mutex:  sync.Mutex{},
-		isOpen: true,
-		log:    log,
+	obj := &ExitPoint{
+		Session:  session,
+		TunnelId: tunnelId,
+		Clients:  NewClientRegistry(),
+		Service:  service,
+		Protocol: protocol,
+
+		mutex:        sync.Mutex{},
+		supervisor:   newSupervisor(session.Context()),
+		compression:  compression,
+		fragments:    newReassembler(),
+		priority:     priority,
+		destinations: options.Destinations,
+		log:          log,
 	}
 
-	go obj.WebsocketWriter()
-	go obj.WebsocketReader()
+	obj.log.Info("Tunnel %s, exit point forwarding to %s://%s", tunnelId, protocol, service)
+
+	obj.supervisor.Start(obj.shutdown, obj.finished)
 
 	return obj, nil
 }
 
-func (self *ExitPoint) ReceiveDataFromWebsocket(clientId string, data []byte) {
-	self.log.Debug("ReceiveDataFromWebsocket")
+// The client data from the peer goes to. Legacy peers open clients
+// implicitly with their first data, that is queued while the client is
+// dialed on the tunnel supervisor.
+func (self *ExitPoint) dataClient(clientId string) *Client {
+	client := self.Clients.Get(clientId)
+	if client != nil {
+		return client
+	}
 
-	self.mutex.Lock()
-	client := self.Clients[clientId]
-	if client == nil {
-		self.log.Trace("Client %s not connected. connecting to %s", clientId, self.Service)
+	if self.Session.HasFeature(messages.Feature.Streams) {
+		self.log.Warn("Receiving data from unexsiten or closed client.")
+		return nil
+	}
 
-		connection, err := net.DialTimeout(self.Protocol, self.Service, 60*time.Second)
+	self.log.Trace("Client %s not connected. connecting to %s", clientId, self.Service)
 
-		if err != nil {
-			// TODO: Handle error on connection failed.
+	client = self.newClient(clientId, nil)
+
+	if !self.addClient(client) {
+		client.Close()
+		return nil
+	}
+
+	started := self.supervisor.Go(func() error {
+		self.connectLegacyClient(client)
+		return nil
+	})
+
+	if !started {
+		self.CloseClient(clientId)
+		return nil
+	}
+
+	return client
+}
+
+// Dials a client opened by the data of a legacy peer. Failures are sent
+// back as an EOF.
+func (self *ExitPoint) connectLegacyClient(client *Client) {
+	connection, err := self.dial(client.ctx)
+
+	if err != nil {
+		if self.IsOpen() && !client.IsClosed() {
 			self.log.Error(err)
-			self.mutex.Unlock()
-			return
+			self.ResetClient(client.id, ErrorCodeOf(err), err)
 		}
+		return
+	}
+
+	if client.connect(connection) {
+		self.startClient(client)
+	}
+}
+
+func (self *ExitPoint) ReceiveDataFromWebsocket(client *Client, data []byte) {
+	self.log.Debug("ReceiveDataFromWebsocket")
+
+	credit, err := client.Enqueue(data)
+
+	if errors.Is(err, ErrWindowExceeded) {
+		self.log.Warn("Client %s, %s. Resetting it", client.id, err)
+		self.ResetClient(client.id, messages.ErrorCode.FlowControl, err)
+	} else if errors.Is(err, ErrQueueOverflow) {
+		self.log.Warn("Client %s, %s. Resetting it", client.id, err)
+		self.ResetClient(client.id, messages.ErrorCode.Overflow, err)
+	} else if errors.Is(err, ErrQueueFull) {
+		self.log.Warn("Client %s, queue full, dropping %d bytes", client.id, len(data))
+	} else if credit > 0 {
+		self.SendWindowUpdate(client, uint32(credit))
+	}
+}
+
+func (self *ExitPoint) dial(ctx context.Context) (net.Conn, error) {
+	// Resolved addresses are checked against the policy as they are dialed
+	dialer := self.destinations.dialer(self.Service)
+	dialer.Timeout = 60 * time.Second
+	return dialer.DialContext(ctx, self.Protocol, self.Service)
+}
 
-		client = NewClient(
+// A client for the connection, that may be set later with connect.
+func (self *ExitPoint) newClient(clientId string, connection net.Conn) *Client {
+	if isPacketProtocol(self.Protocol) {
+		return NewPacketClient(
+			self.supervisor.ctx,
 			clientId,
 			connection,
+			viper.GetDuration("UdpIdleTimeout"),
 			self.log,
 		)
-		self.Clients[clientId] = client
-		go client.ClientHandler(self)
 	}
 
-	writeLen, err := client.connection.Write(data)
+	return NewClient(
+		self.supervisor.ctx,
+		clientId,
+		connection,
+		self.Session.HasFeature(messages.Feature.Flow),
+		self.log,
+	)
+}
 
-	self.mutex.Unlock()
+// Connects a client asked with Open. Dialing does not hold the session
+// reader, the result is sent back as OpenAck or Reset.
+func (self *ExitPoint) openClient(clientId string) {
+	self.log.Trace("Client %s, connecting to %s", clientId, self.Service)
+
+	if self.Clients.Get(clientId) != nil {
+		self.resetDuplicatedClient(clientId)
+		return
+	}
 
-	self.log.Trace("Client %s, write %d bytes", clientId, writeLen)
+	connection, err := self.dial(self.supervisor.ctx)
 
 	if err != nil {
-		//TODO handle error but not EOF
-		self.log.Error(err)
-		self.CloseClient(clientId)
+		if self.IsOpen() {
+			self.log.Error(err)
+			self.Session.Send(messages.ResetMessage(self.TunnelId, clientId, ErrorCodeOf(err), err))
+		}
+		return
+	}
+
+	client := self.newClient(clientId, connection)
+
+	if !self.addClient(client) {
+		client.Close()
+		if self.IsOpen() {
+			self.resetDuplicatedClient(clientId)
+		}
+		return
+	}
+
+	self.Session.Send(messages.OpenAckMessage(self.TunnelId, clientId))
+
+	self.startClient(client)
+}
+
+// A client id opened twice is a protocol error, the stream is dropped on both
+// sides.
+func (self *ExitPoint) resetDuplicatedClient(clientId string) {
+	err := fmt.Errorf("client %s already open", clientId)
+	self.log.Warn(err)
+
+	if client := self.removeClient(clientId); client != nil {
+		client.Reset()
+	}
+
+	self.Session.Send(messages.ResetMessage(self.TunnelId, clientId, messages.ErrorCode.Protocol, err))
+}
+
+// Opens the client and handles its read and write data on the tunnel
+// supervisor. Clients already started are left as they are.
+func (self *ExitPoint) startClient(client *Client) {
+	if !client.start() {
+		return
+	}
+
+	started := self.supervisor.Go(func() error {
+		client.ClientHandler(self)
+		return nil
+	}) && self.supervisor.Go(func() error {
+		client.WriteHandler(self)
+		return nil
+	})
+
+	if !started {
+		client.Close()
 	}
 }
 
 func (self *ExitPoint) ReceiveDataFromClientSocket(client *Client, data []byte) {
 	self.log.Debug("ReceiveDataFromClientSocket")
-	self.WebsocketWritterChannel <- messages.DataMessage(
-		client.id,
-		data,
-	)
+	msg := self.compression.DataMessage(self.TunnelId, client.id, data)
+
+	// Datagrams may not fit a frame of the peer, stream reads always do
+	for _, part := range msg.Fragment(self.Session.MaxPayloadSize()) {
+		self.Session.Send(part)
+	}
+}
+
+func (self *ExitPoint) MaxPayloadSize() int {
+	return self.Session.MaxPayloadSize()
 }
 
-func (self *ExitPoint) WebsocketWriter() {
-	var msg *messages.Message
+func (self *ExitPoint) SendWindowUpdate(client *Client, credit uint32) {
+	self.Session.Send(messages.WindowUpdateMessage(
+		self.TunnelId,
+		client.id,
+		credit,
+	))
+}
 
-	self.log.Debug("WebsocketWritter")
+func (self *ExitPoint) ReceiveEOFFromClientSocket(client *Client) {
+	if self.Session.HasFeature(messages.Feature.Streams) {
+		self.Session.Send(messages.CloseMessage(self.TunnelId, client.id))
+	} else {
+		// Legacy peers take an empty payload as EOF
+		self.Session.Send(messages.DataMessage(self.TunnelId, client.id, nil))
+	}
+}
 
-	for self.isOpen {
-		msg = <-self.WebsocketWritterChannel
+func (self *ExitPoint) ReceiveMessageFromWebsocket(msg *messages.Message) {
+	if msg.Type == messages.MessageType.Open {
+		self.supervisor.Go(func() error {
+			self.openClient(msg.ClientId)
+			return nil
+		})
+		return
+	}
 
-		msgJson, _ := json.Marshal(msg)
-		self.log.Trace("Writting message to websocket %s", msgJson)
+	if msg.Type == messages.MessageType.Data && len(msg.Data) > 0 {
+		whole, err := self.fragments.add(msg)
 
-		err := self.Websocket.WriteJSON(msg)
 		if err != nil {
-			self.TerminateChannel(err)
-			break // TODO: call entrypoint terminate
+			self.log.Error(err)
+			self.ResetClient(msg.ClientId, messages.ErrorCode.TooLarge, err)
+			return
 		}
-	}
-}
 
-func (self *ExitPoint) WebsocketReader() {
-	self.log.Debug("WebsocketReader")
+		if whole == nil {
+			return
+		}
+
+		client := self.dataClient(msg.ClientId)
+		if client == nil {
+			return
+		}
 
-	for self.isOpen {
-		msg := messages.New()
+		data, err := self.compression.Payload(whole, client.room())
 
-		err := self.Websocket.ReadJSON(msg)
 		if err != nil {
-			self.TerminateChannel(err)
-			break // TODO: call entrypoint terminate
+			self.log.Error(err)
+			self.ResetClient(msg.ClientId, payloadErrorCode(err), err)
+			return
 		}
 
-		msgJson, _ := json.Marshal(msg)
-		self.log.Trace("Readed message from websocket %s", msgJson)
+		self.ReceiveDataFromWebsocket(client, data)
+		return
+	}
 
-		// TODO Handle Error messages
+	client := self.Clients.Get(msg.ClientId)
 
-		if msg.Type == messages.MessageType.Data {
-			if len(msg.Data) == 0 {
-				self.log.Trace("Client %s, received EOF from websocket", msg.ClientId)
-				self.CloseClient(msg.ClientId)
-				continue
-			}
+	if client == nil {
+		return
+	}
 
-			self.ReceiveDataFromWebsocket(msg.ClientId, msg.Data)
-		} else {
-			self.WebsocketReaderChannel <- msg
+	switch msg.Type {
+	case messages.MessageType.Reset:
+		self.log.Info("Client %s, reset by peer: %s (%s)", msg.ClientId, msg.Code, msg.Description)
+		if client = self.removeClient(msg.ClientId); client != nil {
+			client.Reset()
 		}
 
+	case messages.MessageType.WindowUpdate:
+		client.GrantWindow(msg.Window)
+
+	default:
+		// Close, or an empty payload from legacy peers. Queued so the EOF is
+		// handled after pending data is written
+		client.Enqueue(nil)
 	}
 }
 
 func (self *ExitPoint) CloseClient(clientId string) {
 	self.log.Debug("CloseClient")
 
-	client := self.Clients[clientId]
-	self.Clients[clientId] = nil
-
-	if client != nil {
+	if client := self.removeClient(clientId); client != nil {
 		self.log.Trace("Closing client %s", clientId)
-		client.connection.Close()
+		client.Close()
+	}
+}
+
+func (self *ExitPoint) ResetClient(clientId string, code string, err error) {
+	client := self.removeClient(clientId)
+
+	if client == nil {
+		return
+	}
+
+	if self.Session.HasFeature(messages.Feature.Streams) {
+		self.Session.Send(messages.ResetMessage(self.TunnelId, clientId, code, err))
+	} else {
+		self.Session.Send(messages.DataMessage(self.TunnelId, clientId, nil))
 	}
+
+	client.Reset()
 }
 
+// Registers the client unless the tunnel was closed meanwhile.
+func (self *ExitPoint) addClient(client *Client) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.IsOpen() && self.Clients.Add(client)
+}
+
+func (self *ExitPoint) removeClient(clientId string) *Client {
+	self.fragments.forget(clientId)
+	return self.Clients.Remove(clientId)
+}
+
+// Stops the tunnel. Every goroutine of it returns shortly after.
 func (self *ExitPoint) CloseChannel() {
 	self.log.Debug("CloseChannel")
-	self.isOpen = false
+	self.supervisor.Stop()
+}
 
-	for clientId, _ := range self.Clients {
-		self.CloseClient(clientId)
+// Releases the clients once the tunnel is stopping. Dials in progress are
+// cancelled by the context.
+func (self *ExitPoint) shutdown() {
+	self.mutex.Lock()
+	clients := self.Clients.RemoveAll()
+	self.mutex.Unlock()
+
+	for _, client := range clients {
+		client.Close()
 	}
+}
+
+func (self *ExitPoint) finished(err error) {
+	if err != nil {
+		self.log.Critical(err)
+	}
+	self.Session.TunnelClosed(self.TunnelId)
+}
+
+// Waits until every goroutine of the tunnel returned. Returns the error that
+// caused the tunnel to close, if any.
+func (self *ExitPoint) Wait() error {
+	return self.supervisor.Wait()
+}
 
-	self.Done <- true
+func (self *ExitPoint) Priority() string {
+	return self.priority
 }
 
-func (self *ExitPoint) TerminateChannel(error error) {
-	self.log.Critical(error)
-	self.CloseChannel()
-	self.Websocket.Close()
+func (self *ExitPoint) Stats() TunnelStats {
+	stats := self.compression.Stats(self.TunnelId)
+	stats.Priority = self.priority
+	return stats
 }
 
 func (self *ExitPoint) IsOpen() bool {
-	return self.isOpen
+	return self.supervisor.IsRunning()
 }
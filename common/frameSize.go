@@ -0,0 +1,86 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/rsrdesarrollo/tunneler/messages"
+	"github.com/spf13/viper"
+)
+
+const (
+	// Assumed for peers that do not announce the largest frame they accept
+	DefaultMaxFrameSize = 1 << 20
+	MinMaxFrameSize     = 16 << 10
+	// Room for everything in a frame but the payload, on any codec
+	frameOverhead = 1024
+)
+
+// A peer sent a frame over the size we announced. The session is torn down.
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// Largest frame we accept, from MaxFrameSize.
+func MaxFrameSizeConfig() int {
+	size := viper.GetInt("MaxFrameSize")
+	if size < MinMaxFrameSize {
+		size = MinMaxFrameSize
+	}
+	return size
+}
+
+// Largest Data payload a frame of frameSize bytes carries. The JSON codec
+// encodes payloads in base64.
+func maxPayloadSize(frameSize int) int {
+	return (frameSize - frameOverhead) / 4 * 3
+}
+
+// Joins the fragments of the Data a tunnel receives, per client.
+type reassembler struct {
+	mutex   sync.Mutex
+	pending map[string][]byte
+}
+
+func newReassembler() *reassembler {
+	return &reassembler{pending: make(map[string][]byte)}
+}
+
+// Returns the whole message once its last fragment is in, nil meanwhile.
+// Only datagrams are fragmented, so a payload can not grow over the largest
+// datagram.
+func (self *reassembler) add(msg *messages.Message) (*messages.Message, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	pending, fragmented := self.pending[msg.ClientId]
+
+	if !fragmented && !msg.More {
+		return msg, nil
+	}
+
+	if len(pending)+len(msg.Data) > maxDatagramSize {
+		delete(self.pending, msg.ClientId)
+		return nil, fmt.Errorf("fragmented payload over %d bytes", maxDatagramSize)
+	}
+
+	pending = append(pending, msg.Data...)
+
+	if msg.More {
+		self.pending[msg.ClientId] = pending
+		return nil, nil
+	}
+
+	delete(self.pending, msg.ClientId)
+
+	whole := *msg
+	whole.Data = pending
+	return &whole, nil
+}
+
+// Drops the fragments of a removed client.
+func (self *reassembler) forget(clientId string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	delete(self.pending, clientId)
+}
@@ -0,0 +1,127 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/rsrdesarrollo/tunneler/messages"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Full method name of the session stream in messages.proto
+const GrpcSessionMethod = "/tunneler.Tunneler/Session"
+
+type GrpcSessionServer interface {
+	ServeSession(stream grpc.ServerStream) error
+}
+
+// Service description of tunneler.Tunneler, as protoc-gen-go-grpc would
+// generate it.
+var GrpcServiceDesc = grpc.ServiceDesc{
+	ServiceName: "tunneler.Tunneler",
+	HandlerType: (*GrpcSessionServer)(nil),
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName: "Session",
+			Handler: func(server interface{}, stream grpc.ServerStream) error {
+				return server.(GrpcSessionServer).ServeSession(stream)
+			},
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "messages/messages.proto",
+}
+
+// Codec encoding messages.Message as protobuf. Its name is "proto" so peers
+// see standard application/grpc+proto calls.
+type GrpcCodec struct{}
+
+func (GrpcCodec) Name() string {
+	return "proto"
+}
+
+// gRPC keeps the buffer until its writer sends it, so it is allocated, not
+// pooled.
+func (GrpcCodec) Marshal(v interface{}) ([]byte, error) {
+	msg, ok := v.(*messages.Message)
+	if !ok {
+		return nil, errors.New("grpc codec can only marshal messages.Message")
+	}
+	return msg.MarshalProto(), nil
+}
+
+func (GrpcCodec) Unmarshal(data []byte, v interface{}) error {
+	msg, ok := v.(*messages.Message)
+	if !ok {
+		return errors.New("grpc codec can only unmarshal messages.Message")
+	}
+	return msg.UnmarshalProto(data)
+}
+
+// Both grpc.ClientStream and grpc.ServerStream
+type grpcStream interface {
+	SendMsg(m interface{}) error
+	RecvMsg(m interface{}) error
+	Context() context.Context
+}
+
+// Transport over a gRPC bidirectional stream, with messages encoded as
+// protobuf.
+type GrpcTransport struct {
+	stream    grpcStream
+	release   func()
+	closeOnce sync.Once
+}
+
+// Wraps a stream. release, if any, is called once on Close to end the stream.
+func NewGrpcTransport(stream grpcStream, release func()) *GrpcTransport {
+	return &GrpcTransport{
+		stream:  stream,
+		release: release,
+	}
+}
+
+func (self *GrpcTransport) SendMessage(msg *messages.Message) error {
+	return self.stream.SendMsg(msg)
+}
+
+func (self *GrpcTransport) ReceiveMessage() (*messages.Message, error) {
+	msg := messages.New()
+
+	err := self.stream.RecvMsg(msg)
+
+	// Messages over the MaxRecvMsgSize of the stream
+	if status.Code(err) == codes.ResourceExhausted {
+		return nil, fmt.Errorf("%w: %s", ErrFrameTooLarge, status.Convert(err).Message())
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+func (self *GrpcTransport) Close() error {
+	self.closeOnce.Do(func() {
+		if self.release != nil {
+			self.release()
+		}
+	})
+	return nil
+}
+
+func (self *GrpcTransport) RemoteAddr() net.Addr {
+	remote, ok := peer.FromContext(self.stream.Context())
+	if !ok {
+		return nil
+	}
+	return remote.Addr
+}
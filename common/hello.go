@@ -0,0 +1,23 @@
+package common
+
+import (
+	"github.com/rsrdesarrollo/tunneler/messages"
+)
+
+// Features this build announces on Hello.
+func Features() []string {
+	features := []string{
+		messages.Feature.Resume,
+		messages.Feature.Udp,
+		messages.Feature.Flow,
+		messages.Feature.Streams,
+		messages.Feature.Zstd,
+		messages.Feature.Priority,
+	}
+
+	for _, codec := range messages.Codecs {
+		features = append(features, messages.CodecFeaturePrefix+codec.Name())
+	}
+
+	return features
+}
@@ -0,0 +1,37 @@
+package common
+
+import (
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Keepalive settings of a transport. Peers that miss MaxMissedPongs pongs in
+// a row are considered dead and the transport is closed.
+type Keepalive struct {
+	// Time between pings, 0 disables them
+	PingInterval time.Duration
+	// Time a ping waits for its pong before being missed
+	PongTimeout    time.Duration
+	MaxMissedPongs int
+	// Time a single write can take, 0 for no limit
+	WriteTimeout time.Duration
+	// Log the RTT at Info when first measured and when it changes
+	// significantly, at Debug otherwise
+	LogRtt bool
+}
+
+func KeepaliveConfig() Keepalive {
+	keepalive := Keepalive{
+		PingInterval:   viper.GetDuration("PingInterval"),
+		PongTimeout:    viper.GetDuration("PongTimeout"),
+		MaxMissedPongs: viper.GetInt("MaxMissedPongs"),
+		WriteTimeout:   viper.GetDuration("WriteTimeout"),
+	}
+
+	if keepalive.MaxMissedPongs < 1 {
+		keepalive.MaxMissedPongs = 1
+	}
+
+	return keepalive
+}
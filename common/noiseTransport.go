@@ -0,0 +1,326 @@
+package common
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/flynn/noise"
+	"github.com/rsrdesarrollo/tunneler/messages"
+	"github.com/spf13/viper"
+)
+
+// Noise protocols, by the keys they need: a shared secret, the static key
+// of the server, or both.
+const (
+	NoiseSecretProtocol          = "Noise_NNpsk0_25519_ChaChaPoly_SHA256"
+	NoiseServerKeyProtocol       = "Noise_NK_25519_ChaChaPoly_SHA256"
+	NoiseServerKeySecretProtocol = "Noise_NKpsk2_25519_ChaChaPoly_SHA256"
+)
+
+// Both peers mix it in the handshake, binding it to tunneler.
+var noisePrologue = []byte("tunneler")
+
+var noiseCipherSuite = noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashSHA256)
+
+var ErrNoiseHandshake = errors.New("encryption handshake failed")
+
+// Keys for end to end encryption. Empty keys are not configured.
+type Encryption struct {
+	// Shared secret, hashed to a 32 bytes pre-shared key
+	Secret []byte
+	// Static key pair of the server
+	PrivateKey []byte
+	PublicKey  []byte
+	// Static public key of the server, known by the client
+	ServerKey []byte
+}
+
+func EncryptionConfig() (Encryption, error) {
+	var encryption Encryption
+	var err error
+
+	if secret := viper.GetString("EncryptionSecret"); secret != "" {
+		psk := sha256.Sum256([]byte(secret))
+		encryption.Secret = psk[:]
+	}
+
+	if privateKey := viper.GetString("EncryptionPrivateKey"); privateKey != "" {
+		encryption.PrivateKey, encryption.PublicKey, err = decodeNoisePrivateKey(privateKey)
+		if err != nil {
+			return encryption, fmt.Errorf("invalid EncryptionPrivateKey: %s", err)
+		}
+	}
+
+	if serverKey := viper.GetString("EncryptionServerKey"); serverKey != "" {
+		encryption.ServerKey, err = base64.StdEncoding.DecodeString(serverKey)
+		if err == nil && len(encryption.ServerKey) != 32 {
+			err = errors.New("must be 32 bytes")
+		}
+		if err != nil {
+			return encryption, fmt.Errorf("invalid EncryptionServerKey: %s", err)
+		}
+	}
+
+	return encryption, nil
+}
+
+func decodeNoisePrivateKey(encoded string) ([]byte, []byte, error) {
+	privateKey, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, err := ecdh.X25519().NewPrivateKey(privateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return key.Bytes(), key.PublicKey().Bytes(), nil
+}
+
+// Generates a static key pair for the server, base64 encoded.
+func GenerateNoiseKey() (string, string, error) {
+	keypair, err := noise.DH25519.GenerateKeypair(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(keypair.Private), base64.StdEncoding.EncodeToString(keypair.Public), nil
+}
+
+// Whether the client has keys to encrypt.
+func (self Encryption) ClientEnabled() bool {
+	return len(self.Secret) > 0 || len(self.ServerKey) > 0
+}
+
+// The protocol the client uses, the strongest its keys allow.
+func (self Encryption) clientProtocol() string {
+	switch {
+	case len(self.ServerKey) > 0 && len(self.Secret) > 0:
+		return NoiseServerKeySecretProtocol
+	case len(self.ServerKey) > 0:
+		return NoiseServerKeyProtocol
+	default:
+		return NoiseSecretProtocol
+	}
+}
+
+func (self Encryption) handshakeConfig(protocol string, initiator bool) (noise.Config, error) {
+	config := noise.Config{
+		CipherSuite: noiseCipherSuite,
+		Initiator:   initiator,
+		Prologue:    noisePrologue,
+	}
+
+	switch protocol {
+	case NoiseSecretProtocol:
+		config.Pattern = noise.HandshakeNN
+		config.PresharedKeyPlacement = 0
+	case NoiseServerKeyProtocol:
+		config.Pattern = noise.HandshakeNK
+	case NoiseServerKeySecretProtocol:
+		config.Pattern = noise.HandshakeNK
+		config.PresharedKeyPlacement = 2
+	default:
+		return config, fmt.Errorf("unsupported encryption protocol %q", protocol)
+	}
+
+	if protocol != NoiseServerKeyProtocol {
+		if len(self.Secret) == 0 {
+			return config, fmt.Errorf("%s needs EncryptionSecret", protocol)
+		}
+		config.PresharedKey = self.Secret
+	}
+
+	if protocol != NoiseSecretProtocol {
+		if initiator {
+			config.PeerStatic = self.ServerKey
+		} else if len(self.PrivateKey) > 0 {
+			config.StaticKeypair = noise.DHKey{Private: self.PrivateKey, Public: self.PublicKey}
+		} else {
+			return config, fmt.Errorf("%s needs EncryptionPrivateKey", protocol)
+		}
+	}
+
+	return config, nil
+}
+
+// Encrypts every message of the wrapped transport. Each one is encoded as a
+// binary frame and sealed with the keys agreed on the Noise handshake.
+type NoiseTransport struct {
+	transport Transport
+	protocol  string
+	send      *noise.CipherState
+	receive   *noise.CipherState
+}
+
+// Runs the client side of the handshake on transport.
+func DialNoiseTransport(transport Transport, encryption Encryption) (*NoiseTransport, error) {
+	protocol := encryption.clientProtocol()
+
+	config, err := encryption.handshakeConfig(protocol, true)
+	if err != nil {
+		return nil, err
+	}
+
+	handshake, err := noise.NewHandshakeState(config)
+	if err != nil {
+		return nil, err
+	}
+
+	request, _, _, err := handshake.WriteMessage(nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = transport.SendMessage(messages.NoiseMessage(protocol, request))
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := transport.ReceiveMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	// Refused by the server, legacy ones answer a protocol mismatch
+	if response.Type == messages.MessageType.Error {
+		return nil, fmt.Errorf("%w: %s", ErrNoiseHandshake, response.Description)
+	} else if response.Type != messages.MessageType.Noise {
+		return nil, ErrNoiseHandshake
+	}
+
+	_, send, receive, err := handshake.ReadMessage(nil, response.Data)
+	if err != nil || send == nil {
+		return nil, ErrNoiseHandshake
+	}
+
+	return &NoiseTransport{
+		transport: transport,
+		protocol:  protocol,
+		send:      send,
+		receive:   receive,
+	}, nil
+}
+
+// Runs the server side of the handshake, started by request. Failures are
+// answered with an Error message.
+func AcceptNoiseTransport(transport Transport, request *messages.Message, encryption Encryption) (*NoiseTransport, error) {
+	send, receive, response, err := encryption.respond(request)
+
+	if err != nil {
+		transport.SendMessage(messages.ErrorMessage(err))
+		return nil, fmt.Errorf("%w: %s", ErrNoiseHandshake, err)
+	}
+
+	err = transport.SendMessage(messages.NoiseMessage(request.Protocol, response))
+	if err != nil {
+		return nil, err
+	}
+
+	return &NoiseTransport{
+		transport: transport,
+		protocol:  request.Protocol,
+		send:      send,
+		receive:   receive,
+	}, nil
+}
+
+// Reads the handshake request of the client and writes the response.
+func (self Encryption) respond(request *messages.Message) (*noise.CipherState, *noise.CipherState, []byte, error) {
+	config, err := self.handshakeConfig(request.Protocol, false)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	handshake, err := noise.NewHandshakeState(config)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	_, _, _, err = handshake.ReadMessage(nil, request.Data)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	response, receive, send, err := handshake.WriteMessage(nil, nil)
+	if err == nil && send == nil {
+		err = errors.New("incomplete handshake")
+	}
+
+	return send, receive, response, err
+}
+
+func (self *NoiseTransport) Protocol() string {
+	return self.protocol
+}
+
+// Transports encode the envelope before SendMessage returns, so the frame
+// and the ciphertext are built in pooled buffers.
+func (self *NoiseTransport) SendMessage(msg *messages.Message) error {
+	frameBuffer := messages.GetFrameBuffer()
+	defer messages.PutFrameBuffer(frameBuffer)
+
+	frame, err := msg.AppendFrame(*frameBuffer)
+	if err != nil {
+		return err
+	}
+	*frameBuffer = frame
+
+	ciphertextBuffer := messages.GetFrameBuffer()
+	defer messages.PutFrameBuffer(ciphertextBuffer)
+
+	ciphertext, err := self.send.Encrypt(*ciphertextBuffer, nil, frame)
+	if err != nil {
+		return err
+	}
+	*ciphertextBuffer = ciphertext
+
+	return self.transport.SendMessage(messages.EncryptedMessage(ciphertext))
+}
+
+func (self *NoiseTransport) ReceiveMessage() (*messages.Message, error) {
+	envelope, err := self.transport.ReceiveMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	if envelope.Type != messages.MessageType.Encrypted {
+		return nil, fmt.Errorf("unencrypted %s message on an encrypted transport", envelope.Type)
+	}
+
+	frame, err := self.receive.Decrypt(nil, nil, envelope.Data)
+	if err != nil {
+		return nil, errors.New("unable to decrypt message")
+	}
+
+	msg := messages.New()
+	err = msg.UnmarshalFrame(frame)
+	if err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+func (self *NoiseTransport) Close() error {
+	return self.transport.Close()
+}
+
+func (self *NoiseTransport) RemoteAddr() net.Addr {
+	return self.transport.RemoteAddr()
+}
+
+// Round trip time measured by the wrapped transport, if it does.
+func (self *NoiseTransport) RTT() time.Duration {
+	if meter, ok := self.transport.(interface{ RTT() time.Duration }); ok {
+		return meter.RTT()
+	}
+	return 0
+}
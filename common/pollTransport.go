@@ -0,0 +1,327 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rsrdesarrollo/tunneler/messages"
+)
+
+// Most messages sent on a single HTTP request or response
+const pollBatchSize = 64
+
+var errPollTransportClosed = errors.New("poll transport closed")
+
+// Transport over plain HTTP for proxies that do not allow websockets. The
+// client POSTs batches of messages and long-polls with GET for the messages
+// of the server. Both ends are tied by a session cookie.
+type PollTransport struct {
+	incoming chan *messages.Message
+	// Encoded as they are sent, messages may be released right after
+	outgoing   chan json.RawMessage
+	closed     chan struct{}
+	closeOnce  sync.Once
+	mutex      sync.Mutex
+	err        error
+	remoteAddr net.Addr
+	readLimit  int
+	release    func()
+}
+
+// Batches of the peer are limited to readLimit bytes per message.
+func newPollTransport(remoteAddr net.Addr, readLimit int) *PollTransport {
+	return &PollTransport{
+		incoming:   make(chan *messages.Message, pollBatchSize),
+		outgoing:   make(chan json.RawMessage, pollBatchSize),
+		closed:     make(chan struct{}),
+		remoteAddr: remoteAddr,
+		readLimit:  readLimit,
+	}
+}
+
+// Server side of a poll transport. Requests of the client are handed over
+// with DecodeBatch, Deliver and Collect.
+func NewPollServerTransport(remoteAddr net.Addr, readLimit int) *PollTransport {
+	return newPollTransport(remoteAddr, readLimit)
+}
+
+// Decodes a batch of the peer. Batches over the read limit fail with
+// ErrFrameTooLarge.
+func (self *PollTransport) DecodeBatch(body io.Reader) ([]*messages.Message, error) {
+	return decodePollBatch(body, self.readLimit)
+}
+
+func decodePollBatch(body io.Reader, readLimit int) ([]*messages.Message, error) {
+	var batch []*messages.Message
+	var tooLarge *http.MaxBytesError
+
+	if readLimit > 0 {
+		body = http.MaxBytesReader(nil, io.NopCloser(body), int64(readLimit)*pollBatchSize)
+	}
+
+	err := json.NewDecoder(body).Decode(&batch)
+
+	if errors.As(err, &tooLarge) {
+		return nil, fmt.Errorf("%w: peer sent a batch over the %d bytes limit", ErrFrameTooLarge, tooLarge.Limit)
+	}
+
+	return batch, err
+}
+
+func (self *PollTransport) SendMessage(msg *messages.Message) error {
+	encoded, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case self.outgoing <- encoded:
+		return nil
+	case <-self.closed:
+		return self.Err()
+	}
+}
+
+func (self *PollTransport) ReceiveMessage() (*messages.Message, error) {
+	select {
+	case msg := <-self.incoming:
+		return msg, nil
+	case <-self.closed:
+		return nil, self.Err()
+	}
+}
+
+func (self *PollTransport) Close() error {
+	self.Fail(errPollTransportClosed)
+	return nil
+}
+
+// Closes the transport, ReceiveMessage and SendMessage will return err.
+func (self *PollTransport) Fail(err error) {
+	self.closeOnce.Do(func() {
+		self.mutex.Lock()
+		self.err = err
+		self.mutex.Unlock()
+
+		close(self.closed)
+
+		if self.release != nil {
+			self.release()
+		}
+	})
+}
+
+func (self *PollTransport) Err() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.err == nil {
+		return errPollTransportClosed
+	}
+	return self.err
+}
+
+func (self *PollTransport) RemoteAddr() net.Addr {
+	return self.remoteAddr
+}
+
+// Queues messages POSTed by the peer.
+func (self *PollTransport) Deliver(batch []*messages.Message) error {
+	for _, msg := range batch {
+		select {
+		case self.incoming <- msg:
+		case <-self.closed:
+			return self.Err()
+		}
+	}
+	return nil
+}
+
+// Waits up to timeout for messages to the peer, and takes as many as fit on
+// a batch.
+func (self *PollTransport) Collect(timeout time.Duration) ([]json.RawMessage, error) {
+	batch := make([]json.RawMessage, 0, pollBatchSize)
+
+	select {
+	case msg := <-self.outgoing:
+		batch = append(batch, msg)
+	case <-time.After(timeout):
+		return batch, nil
+	case <-self.closed:
+		return nil, self.Err()
+	}
+
+	for len(batch) < pollBatchSize {
+		select {
+		case msg := <-self.outgoing:
+			batch = append(batch, msg)
+		default:
+			return batch, nil
+		}
+	}
+	return batch, nil
+}
+
+// Opens a poll transport against endpoint. As websocket.Dialer.Dial does, the
+// HTTP response is returned when the server refuses the transport.
+// httpClient must keep cookies.
+func DialPollTransport(endpoint string, header http.Header, httpClient *http.Client, readLimit int) (*PollTransport, *http.Response, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	client := &pollClient{
+		endpoint:   endpoint,
+		header:     header,
+		httpClient: httpClient,
+		ctx:        ctx,
+		readLimit:  readLimit,
+	}
+
+	// The first poll gets the session cookie
+	response, _, err := client.poll()
+	if err != nil {
+		cancel()
+		return nil, response, err
+	}
+
+	remoteAddr, _ := net.ResolveTCPAddr("tcp", response.Request.URL.Host)
+
+	transport := newPollTransport(remoteAddr, readLimit)
+	transport.release = func() {
+		client.close()
+		cancel()
+	}
+
+	go client.sender(transport)
+	go client.poller(transport)
+
+	return transport, response, nil
+}
+
+type pollClient struct {
+	endpoint   string
+	header     http.Header
+	httpClient *http.Client
+	ctx        context.Context
+	readLimit  int
+}
+
+func (self *pollClient) request(method string, body []byte) (*http.Response, error) {
+	request, err := http.NewRequest(method, self.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	request = request.WithContext(self.ctx)
+	for key, values := range self.header {
+		request.Header[key] = values
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := self.httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return response, fmt.Errorf("poll transport: unexpected status %s", response.Status)
+	}
+
+	return response, nil
+}
+
+func (self *pollClient) poll() (*http.Response, []*messages.Message, error) {
+	response, err := self.request(http.MethodGet, nil)
+	if err != nil {
+		return response, nil, err
+	}
+	defer response.Body.Close()
+
+	batch, err := decodePollBatch(response.Body, self.readLimit)
+
+	return response, batch, err
+}
+
+// Long-polls the server for messages.
+func (self *pollClient) poller(transport *PollTransport) {
+	for {
+		_, batch, err := self.poll()
+
+		if err == nil {
+			err = transport.Deliver(batch)
+		}
+
+		if err != nil {
+			transport.Fail(err)
+			return
+		}
+	}
+}
+
+// POSTs queued messages to the server, in batches.
+func (self *pollClient) sender(transport *PollTransport) {
+	for {
+		batch := make([]json.RawMessage, 0, pollBatchSize)
+
+		select {
+		case msg := <-transport.outgoing:
+			batch = append(batch, msg)
+		case <-transport.closed:
+			return
+		}
+
+	collecting:
+		for len(batch) < pollBatchSize {
+			select {
+			case msg := <-transport.outgoing:
+				batch = append(batch, msg)
+			default:
+				break collecting
+			}
+		}
+
+		body, err := json.Marshal(batch)
+
+		if err == nil {
+			var response *http.Response
+			response, err = self.request(http.MethodPost, body)
+			if err == nil {
+				response.Body.Close()
+			}
+		}
+
+		if err != nil {
+			transport.Fail(err)
+			return
+		}
+	}
+}
+
+// Tells the server the transport is over. Best effort.
+func (self *pollClient) close() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	request, err := http.NewRequest(http.MethodDelete, self.endpoint, nil)
+	if err != nil {
+		return
+	}
+
+	request = request.WithContext(ctx)
+	for key, values := range self.header {
+		request.Header[key] = values
+	}
+
+	response, err := self.httpClient.Do(request)
+	if err == nil {
+		response.Body.Close()
+	}
+}
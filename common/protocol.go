@@ -0,0 +1,8 @@
+package common
+
+import "strings"
+
+// Tells if the protocol is datagram based (udp, udp4, udp6)
+func isPacketProtocol(protocol string) bool {
+	return strings.HasPrefix(protocol, "udp")
+}
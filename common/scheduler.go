@@ -0,0 +1,167 @@
+package common
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/rsrdesarrollo/tunneler/messages"
+)
+
+const (
+	// Messages a client can have waiting to be written
+	flowQueueSize = 4
+	// Bytes a normal priority client writes on its turn. Every message
+	// costs its payload plus messageCost.
+	baseQuantum = 32 * 1024
+	messageCost = 64
+)
+
+// Parses a priority name from a tunnel spec.
+func ParsePriority(name string) (string, error) {
+	switch name {
+	case "", "normal":
+		return messages.Priority.Normal, nil
+	case messages.Priority.Interactive, messages.Priority.Bulk:
+		return name, nil
+	default:
+		return "", fmt.Errorf("unsupported priority %q", name)
+	}
+}
+
+// Turns of the priority classes: bytes written on every round.
+func priorityQuantum(priority string) int {
+	switch priority {
+	case messages.Priority.Interactive:
+		return 4 * baseQuantum
+	case messages.Priority.Bulk:
+		return baseQuantum / 2
+	default:
+		return baseQuantum
+	}
+}
+
+// Messages of a client waiting to be written
+type flow struct {
+	key      string
+	queue    []*messages.Message
+	quantum  int
+	deficit  int
+	credited bool
+}
+
+// Shares the session between its clients with deficit weighted round robin.
+// Every client with messages waiting gets a turn in which it writes up to
+// the quantum of its priority, so a bulk transfer can not starve the rest.
+// Interactive clients join the round first, they are rarely busy and are
+// served as soon as they have something to write.
+type writeScheduler struct {
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	closed bool
+	flows  map[string]*flow
+	active []*flow
+	// Signaled when a message is queued
+	ready chan struct{}
+}
+
+func newWriteScheduler() *writeScheduler {
+	obj := &writeScheduler{
+		flows: make(map[string]*flow),
+		ready: make(chan struct{}, 1),
+	}
+	obj.cond = sync.NewCond(&obj.mutex)
+	return obj
+}
+
+// Queues a message of a client. Blocks while the client has a full queue.
+// Returns false if the scheduler was closed.
+func (self *writeScheduler) enqueue(msg *messages.Message, priority string) bool {
+	key := msg.TunnelId + "/" + msg.ClientId
+
+	self.mutex.Lock()
+
+	for !self.closed && self.flows[key] != nil && len(self.flows[key].queue) >= flowQueueSize {
+		self.cond.Wait()
+	}
+
+	if self.closed {
+		self.mutex.Unlock()
+		return false
+	}
+
+	current := self.flows[key]
+
+	if current == nil {
+		current = &flow{
+			key:     key,
+			quantum: priorityQuantum(priority),
+		}
+		self.flows[key] = current
+
+		if priority == messages.Priority.Interactive {
+			self.active = append([]*flow{current}, self.active...)
+		} else {
+			self.active = append(self.active, current)
+		}
+	}
+
+	current.queue = append(current.queue, msg)
+	self.mutex.Unlock()
+
+	select {
+	case self.ready <- struct{}{}:
+	default:
+	}
+
+	return true
+}
+
+// The next message to write, nil if there is none.
+func (self *writeScheduler) next() *messages.Message {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	for len(self.active) > 0 {
+		current := self.active[0]
+
+		if !current.credited {
+			current.deficit += current.quantum
+			current.credited = true
+		}
+
+		msg := current.queue[0]
+		cost := len(msg.Data) + messageCost
+
+		if cost > current.deficit {
+			// Turn over, the deficit is kept for the next round
+			current.credited = false
+			self.active = append(self.active[1:], current)
+			continue
+		}
+
+		current.deficit -= cost
+		current.queue[0] = nil
+		current.queue = current.queue[1:]
+
+		if len(current.queue) == 0 {
+			delete(self.flows, current.key)
+			self.active = self.active[1:]
+		}
+
+		self.cond.Broadcast()
+		return msg
+	}
+
+	return nil
+}
+
+// Releases everything waiting to queue a message.
+func (self *writeScheduler) close() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.closed = true
+	self.flows = make(map[string]*flow)
+	self.active = nil
+	self.cond.Broadcast()
+}
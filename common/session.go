@@ -0,0 +1,666 @@
+package common
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/log4go"
+	"github.com/rsrdesarrollo/tunneler/messages"
+)
+
+const (
+	// Received messages that trigger an Ack if there is no traffic to piggyback it
+	ackThreshold = 32
+	// Maximum time an Ack can be delayed
+	ackFlushInterval = time.Second
+)
+
+// A tunnel carried by a Session. Data messages addressed to the tunnel id are
+// handed over to it.
+type Tunnel interface {
+	ReceiveMessageFromWebsocket(msg *messages.Message)
+	CloseChannel()
+	// Waits for the goroutines of a closed tunnel
+	Wait() error
+	IsOpen() bool
+	Stats() TunnelStats
+	// Scheduling class of the clients of the tunnel, see messages.Priority
+	Priority() string
+}
+
+type sessionTunnel struct {
+	tunnel    Tunnel
+	closeType string
+}
+
+// Handles every non data message. It runs on the reader loop, so tunnels
+// it registers are in place before their first data message is read.
+type ControlHandler func(session *Session, msg *messages.Message)
+
+// A transport currently carrying the session.
+type sessionAttachment struct {
+	transport Transport
+	peerAck   uint64
+	lost      chan struct{}
+	sendMutex sync.Mutex
+}
+
+// Session multiplexes any number of tunnels over a single transport.
+//
+// Sessions with an Id are resumable: every message is sequenced and kept
+// until the peer acknowledges it, so when the transport is lost the session
+// is just detached and, once a new transport is attached, unacknowledged
+// messages are replayed and tunnels go on as if nothing happened.
+type Session struct {
+	Id            string
+	ResumeTimeout time.Duration
+	WriterChannel chan *messages.Message
+	Detached      chan error
+	// Closed once the session ends
+	Done <-chan struct{}
+	// Features agreed with the peer on Hello. Set before adding tunnels.
+	Features []string
+	// Largest frame we accept, 0 for no limit, and the largest the peer
+	// accepts, 0 if it did not announce it
+	MaxFrameSize     int
+	PeerMaxFrameSize int
+	// Called once for every tunnel that closes, if set. Set before adding
+	// tunnels.
+	OnTunnelClosed func(tunnelId string)
+
+	ctx            context.Context
+	cancel         context.CancelFunc
+	mutex          sync.Mutex
+	attachMutex    sync.Mutex
+	isOpen         bool
+	err            error
+	tunnels        map[string]*sessionTunnel
+	controlHandler ControlHandler
+	log            log4go.Logger
+	// Messages are only serialized for the log at trace level
+	trace bool
+
+	attachment    *sessionAttachment
+	attachChannel chan *sessionAttachment
+	attachCount   int
+
+	// Client messages wait on per client queues, the rest on WriterChannel
+	scheduler *writeScheduler
+
+	// Messages up to peerAck are released by the writer, the only one that
+	// reads them
+	sentSeq     uint64
+	receivedSeq uint64
+	ackedSeq    uint64
+	peerAck     uint64
+	unacked     []*messages.Message
+	ackRequest  chan bool
+}
+
+// Whether the logger writes trace messages.
+func traceEnabled(log log4go.Logger) bool {
+	for _, filter := range log {
+		if filter.Level <= log4go.TRACE {
+			return true
+		}
+	}
+	return false
+}
+
+func NewSessionId() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Creates a session. An empty id creates a non resumable session. The
+// session starts detached, see Attach.
+func NewSession(id string, controlHandler ControlHandler, log log4go.Logger) *Session {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	obj := &Session{
+		Id:            id,
+		WriterChannel: make(chan *messages.Message, 10),
+		Detached:      make(chan error, 1),
+		Done:          ctx.Done(),
+
+		ctx:            ctx,
+		cancel:         cancel,
+		mutex:          sync.Mutex{},
+		isOpen:         true,
+		tunnels:        make(map[string]*sessionTunnel),
+		controlHandler: controlHandler,
+		log:            log,
+		trace:          traceEnabled(log),
+
+		attachChannel: make(chan *sessionAttachment, 1),
+		ackRequest:    make(chan bool, 1),
+		scheduler:     newWriteScheduler(),
+	}
+
+	// Writer Loop
+	go obj.Writer()
+
+	return obj
+}
+
+// Attaches a transport to the session. Messages not acknowledged by the peer
+// (peerAck is the last sequence it got) are sent again. The returned channel
+// is closed once this transport stops carrying the session.
+func (self *Session) Attach(transport Transport, peerAck uint64) (<-chan struct{}, error) {
+	self.attachMutex.Lock()
+	defer self.attachMutex.Unlock()
+
+	attachment := &sessionAttachment{
+		transport: transport,
+		peerAck:   peerAck,
+		lost:      make(chan struct{}),
+	}
+
+	self.mutex.Lock()
+	if !self.isOpen {
+		self.mutex.Unlock()
+		return nil, errors.New("session already closed")
+	}
+	previous := self.attachment
+	self.attachment = attachment
+	self.attachCount++
+	self.mutex.Unlock()
+
+	if previous != nil {
+		self.log.Info("Session %s, replacing transport from %s", self.Id, previous.transport.RemoteAddr())
+		close(previous.lost)
+		previous.transport.Close()
+	}
+
+	select {
+	case <-self.Detached:
+	default:
+	}
+
+	select {
+	case <-self.attachChannel:
+	default:
+	}
+	self.attachChannel <- attachment
+
+	// Reader Loop
+	go self.Reader(attachment)
+
+	return attachment.lost, nil
+}
+
+// Registers a tunnel on the session. closeType is the message sent to the
+// peer when the tunnel is closed from this side.
+func (self *Session) AddTunnel(tunnelId string, tunnel Tunnel, closeType string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.tunnels[tunnelId] = &sessionTunnel{
+		tunnel:    tunnel,
+		closeType: closeType,
+	}
+}
+
+func (self *Session) Tunnel(tunnelId string) Tunnel {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	registered := self.tunnels[tunnelId]
+	if registered == nil {
+		return nil
+	}
+	return registered.tunnel
+}
+
+func (self *Session) TunnelCount() int {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return len(self.tunnels)
+}
+
+// Called by the tunnels once closed. If the close was not requested by the
+// peer, it gets notified.
+func (self *Session) TunnelClosed(tunnelId string) {
+	self.mutex.Lock()
+	registered := self.tunnels[tunnelId]
+	delete(self.tunnels, tunnelId)
+	self.mutex.Unlock()
+
+	if registered != nil && self.IsOpen() {
+		self.Send(messages.CloseTunnelMessage(registered.closeType, tunnelId))
+	}
+
+	if self.OnTunnelClosed != nil {
+		self.OnTunnelClosed(tunnelId)
+	}
+}
+
+// Closes a tunnel because the peer asked for it.
+func (self *Session) CloseTunnel(tunnelId string) {
+	self.mutex.Lock()
+	registered := self.tunnels[tunnelId]
+	delete(self.tunnels, tunnelId)
+	self.mutex.Unlock()
+
+	if registered != nil {
+		self.log.Info("Tunnel %s closed by peer", tunnelId)
+		registered.tunnel.CloseChannel()
+	}
+}
+
+func (self *Session) HasFeature(feature string) bool {
+	for _, candidate := range self.Features {
+		if candidate == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// Largest Data payload the peer accepts.
+func (self *Session) MaxPayloadSize() int {
+	if self.PeerMaxFrameSize > 0 {
+		return maxPayloadSize(self.PeerMaxFrameSize)
+	}
+	return maxPayloadSize(DefaultMaxFrameSize)
+}
+
+// Queues a message to the peer. Messages of a client are written in order
+// on its turn, window updates and the rest of messages go ahead of them.
+func (self *Session) Send(msg *messages.Message) {
+	if msg.IsClientMessage() && msg.Type != messages.MessageType.WindowUpdate {
+		self.scheduler.enqueue(msg, self.tunnelPriority(msg.TunnelId))
+		return
+	}
+
+	select {
+	case self.WriterChannel <- msg:
+	case <-self.Done:
+	}
+}
+
+func (self *Session) tunnelPriority(tunnelId string) string {
+	if tunnel := self.Tunnel(tunnelId); tunnel != nil {
+		return tunnel.Priority()
+	}
+	return messages.Priority.Normal
+}
+
+// The next message to write, if any. Messages on WriterChannel go first.
+func (self *Session) nextMessage() *messages.Message {
+	select {
+	case msg := <-self.WriterChannel:
+		return msg
+	default:
+		return self.scheduler.next()
+	}
+}
+
+func (self *Session) Writer() {
+	self.log.Debug("Writer")
+
+	ticker := time.NewTicker(ackFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		var attachment *sessionAttachment
+
+		select {
+		case attachment = <-self.attachChannel:
+		case <-self.Done:
+			return
+		}
+
+		if !self.replay(attachment) {
+			continue
+		}
+
+		for attached := true; attached; {
+			if msg := self.nextMessage(); msg != nil {
+				self.sequence(msg)
+				attached = self.write(attachment, msg)
+				continue
+			}
+
+			select {
+			case msg := <-self.WriterChannel:
+				self.sequence(msg)
+				attached = self.write(attachment, msg)
+
+			case <-self.scheduler.ready:
+
+			case <-self.ackRequest:
+				attached = self.write(attachment, messages.AckMessage())
+
+			case <-ticker.C:
+				self.mutex.Lock()
+				self.discardAcknowledged()
+				self.mutex.Unlock()
+
+				if self.pendingAck() {
+					attached = self.write(attachment, messages.AckMessage())
+				}
+
+			case <-attachment.lost:
+				attached = false
+
+			case <-self.Done:
+				return
+			}
+		}
+	}
+}
+
+func (self *Session) Reader(attachment *sessionAttachment) {
+	self.log.Debug("Reader")
+
+	for {
+		msg, err := attachment.transport.ReceiveMessage()
+
+		if err == nil && self.MaxFrameSize > 0 && len(msg.Data) > self.MaxFrameSize {
+			err = fmt.Errorf("%w: peer sent a %d bytes payload, over the %d bytes limit", ErrFrameTooLarge, len(msg.Data), self.MaxFrameSize)
+		}
+
+		if errors.Is(err, ErrFrameTooLarge) {
+			// Resuming would replay the same frame
+			self.log.Error("Session %s, %s", self.Id, err)
+			self.TerminateSession(err)
+			return
+		}
+
+		if err != nil {
+			self.connectionLost(attachment, err)
+			return
+		}
+
+		if self.trace {
+			msgJson, _ := json.Marshal(msg)
+			self.log.Trace("Readed message from transport %s", msgJson)
+		}
+
+		if !self.acknowledge(msg) {
+			self.log.Trace("Dropping replayed message %d", msg.Seq)
+			continue
+		}
+
+		if msg.IsClientMessage() {
+			tunnel := self.Tunnel(msg.TunnelId)
+			if tunnel == nil {
+				self.log.Warn("Receiving data for unexistent or closed tunnel %s.", msg.TunnelId)
+				continue
+			}
+			tunnel.ReceiveMessageFromWebsocket(msg)
+			continue
+		}
+
+		switch msg.Type {
+		case messages.MessageType.CloseLocalTunnel, messages.MessageType.CloseRemoteTunnel:
+			self.CloseTunnel(msg.TunnelId)
+
+		case messages.MessageType.Ack:
+
+		case messages.MessageType.CloseSession:
+			self.log.Info("Session %s closed by peer", self.Id)
+			self.CloseSession()
+			return
+
+		default:
+			self.controlHandler(self, msg)
+		}
+	}
+}
+
+// Numbers the message and keeps it until acknowledged.
+func (self *Session) sequence(msg *messages.Message) {
+	if self.Id == "" || msg.IsSessionMessage() {
+		return
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.discardAcknowledged()
+
+	self.sentSeq++
+	msg.Seq = self.sentSeq
+	self.unacked = append(self.unacked, msg)
+}
+
+// Sends every message the peer has not acknowledged yet.
+func (self *Session) replay(attachment *sessionAttachment) bool {
+	self.mutex.Lock()
+	if attachment.peerAck > self.peerAck {
+		self.peerAck = attachment.peerAck
+	}
+	self.discardAcknowledged()
+	pending := make([]*messages.Message, len(self.unacked))
+	copy(pending, self.unacked)
+	self.mutex.Unlock()
+
+	if len(pending) > 0 {
+		self.log.Info("Session %s, replaying %d messages", self.Id, len(pending))
+	}
+
+	for _, msg := range pending {
+		if !self.write(attachment, msg) {
+			return false
+		}
+	}
+	return true
+}
+
+func (self *Session) write(attachment *sessionAttachment, msg *messages.Message) bool {
+	if self.Id != "" {
+		self.mutex.Lock()
+		msg.Ack = self.receivedSeq
+		self.ackedSeq = self.receivedSeq
+		self.mutex.Unlock()
+	}
+
+	if self.trace {
+		msgJson, _ := json.Marshal(msg)
+		self.log.Trace("Writting message to transport %s", msgJson)
+	}
+
+	attachment.sendMutex.Lock()
+	err := attachment.transport.SendMessage(msg)
+	attachment.sendMutex.Unlock()
+
+	// Transports are done with the message once sent. Resumable sessions
+	// keep it until acknowledged.
+	if self.Id == "" {
+		msg.Release()
+	}
+
+	if err != nil {
+		self.connectionLost(attachment, err)
+		return false
+	}
+	return true
+}
+
+// Processes the sequence and acknowledge of a received message. Returns false
+// if the message was already received before a resume.
+func (self *Session) acknowledge(msg *messages.Message) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if msg.Ack > self.peerAck {
+		self.peerAck = msg.Ack
+	}
+
+	if msg.Seq == 0 {
+		return true
+	}
+
+	if msg.Seq <= self.receivedSeq {
+		return false
+	}
+
+	self.receivedSeq = msg.Seq
+
+	if self.receivedSeq-self.ackedSeq >= ackThreshold {
+		select {
+		case self.ackRequest <- true:
+		default:
+		}
+	}
+
+	return true
+}
+
+// Releases the messages the peer acknowledged. Called by the writer with the
+// mutex held.
+func (self *Session) discardAcknowledged() {
+	acknowledged := 0
+	for acknowledged < len(self.unacked) && self.unacked[acknowledged].Seq <= self.peerAck {
+		self.unacked[acknowledged].Release()
+		self.unacked[acknowledged] = nil
+		acknowledged++
+	}
+	self.unacked = self.unacked[acknowledged:]
+}
+
+func (self *Session) pendingAck() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.Id != "" && self.receivedSeq > self.ackedSeq
+}
+
+// Last sequence received from the peer, to be sent when resuming.
+func (self *Session) ReceivedSeq() uint64 {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.receivedSeq
+}
+
+func (self *Session) connectionLost(attachment *sessionAttachment, err error) {
+	self.mutex.Lock()
+	if !self.isOpen || self.attachment != attachment {
+		self.mutex.Unlock()
+		return
+	}
+	self.attachment = nil
+	attachCount := self.attachCount
+	self.mutex.Unlock()
+
+	close(attachment.lost)
+	attachment.transport.Close()
+
+	if self.Id == "" {
+		self.TerminateSession(err)
+		return
+	}
+
+	self.log.Warn("Session %s, connection lost (%s)", self.Id, err)
+
+	select {
+	case self.Detached <- err:
+	default:
+	}
+
+	if self.ResumeTimeout > 0 {
+		time.AfterFunc(self.ResumeTimeout, func() {
+			self.mutex.Lock()
+			resumed := self.attachment != nil || self.attachCount != attachCount
+			self.mutex.Unlock()
+
+			if !resumed {
+				self.TerminateSession(fmt.Errorf("session not resumed after %s: %s", self.ResumeTimeout, err))
+			}
+		})
+	}
+}
+
+func (self *Session) CloseSession() {
+	self.mutex.Lock()
+	if !self.isOpen {
+		self.mutex.Unlock()
+		return
+	}
+	self.isOpen = false
+
+	tunnels := self.tunnels
+	self.tunnels = make(map[string]*sessionTunnel)
+
+	attachment := self.attachment
+	self.attachment = nil
+	self.mutex.Unlock()
+
+	self.cancel()
+	self.scheduler.close()
+
+	for _, registered := range tunnels {
+		registered.tunnel.CloseChannel()
+	}
+
+	for tunnelId, registered := range tunnels {
+		if err := registered.tunnel.Wait(); err != nil {
+			self.log.Debug("Tunnel %s, closed by %s", tunnelId, err)
+		}
+	}
+
+	if attachment != nil {
+		close(attachment.lost)
+		self.sayGoodbye(attachment)
+		attachment.transport.Close()
+	}
+}
+
+// Lets the peer know the session is over, so it does not wait for a resume.
+// Gives up after a second if the transport is stuck.
+func (self *Session) sayGoodbye(attachment *sessionAttachment) {
+	sent := make(chan bool, 1)
+
+	go func() {
+		attachment.sendMutex.Lock()
+		defer attachment.sendMutex.Unlock()
+
+		sent <- attachment.transport.SendMessage(messages.CloseSessionMessage()) == nil
+	}()
+
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+	}
+}
+
+// Closes the session because of an error, that can be later retrieved with Err.
+func (self *Session) TerminateSession(error error) {
+	self.mutex.Lock()
+	if self.isOpen && self.err == nil {
+		self.err = error
+	}
+	self.mutex.Unlock()
+
+	self.CloseSession()
+}
+
+// Cancelled once the session ends. Tunnels run bound to it.
+func (self *Session) Context() context.Context {
+	return self.ctx
+}
+
+func (self *Session) Err() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.err
+}
+
+func (self *Session) IsOpen() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.isOpen
+}
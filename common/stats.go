@@ -0,0 +1,76 @@
+package common
+
+import (
+	"sort"
+	"time"
+)
+
+// Snapshot of a session for monitoring.
+type SessionStats struct {
+	Id         string        `json:"id"`
+	RemoteAddr string        `json:"remote_addr,omitempty"`
+	Attached   bool          `json:"attached"`
+	RttMs      float64       `json:"rtt_ms"`
+	Tunnels    []TunnelStats `json:"tunnels"`
+}
+
+// Bytes of Data payloads, raw as read from or written to the clients and
+// on the wire after compression.
+type TunnelStats struct {
+	Id               string  `json:"id"`
+	Priority         string  `json:"priority,omitempty"`
+	Compression      string  `json:"compression,omitempty"`
+	RawSent          uint64  `json:"raw_sent"`
+	WireSent         uint64  `json:"wire_sent"`
+	RawReceived      uint64  `json:"raw_received"`
+	WireReceived     uint64  `json:"wire_received"`
+	CompressionRatio float64 `json:"compression_ratio"`
+}
+
+func (self *Session) Stats() SessionStats {
+	self.mutex.Lock()
+	attachment := self.attachment
+	registered := make([]Tunnel, 0, len(self.tunnels))
+	for _, tunnel := range self.tunnels {
+		registered = append(registered, tunnel.tunnel)
+	}
+	self.mutex.Unlock()
+
+	tunnels := make([]TunnelStats, 0, len(registered))
+	for _, tunnel := range registered {
+		tunnels = append(tunnels, tunnel.Stats())
+	}
+
+	sort.Slice(tunnels, func(i, j int) bool {
+		return tunnels[i].Id < tunnels[j].Id
+	})
+
+	stats := SessionStats{
+		Id:       self.Id,
+		Attached: attachment != nil,
+		RttMs:    float64(self.RTT()) / float64(time.Millisecond),
+		Tunnels:  tunnels,
+	}
+
+	if attachment != nil && attachment.transport.RemoteAddr() != nil {
+		stats.RemoteAddr = attachment.transport.RemoteAddr().String()
+	}
+
+	return stats
+}
+
+// Round trip time measured by the attached transport, 0 if unknown.
+func (self *Session) RTT() time.Duration {
+	self.mutex.Lock()
+	attachment := self.attachment
+	self.mutex.Unlock()
+
+	if attachment == nil {
+		return 0
+	}
+
+	if meter, ok := attachment.transport.(interface{ RTT() time.Duration }); ok {
+		return meter.RTT()
+	}
+	return 0
+}
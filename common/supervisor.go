@@ -0,0 +1,80 @@
+package common
+
+import (
+	"context"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// Runs the goroutines of a tunnel point bound to a context, errgroup style:
+// the first one to fail, or Stop, stops every other.
+type supervisor struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	group  *errgroup.Group
+	mutex  sync.Mutex
+	done   chan struct{}
+	err    error
+}
+
+func newSupervisor(parent context.Context) *supervisor {
+	ctx, cancel := context.WithCancel(parent)
+	group, groupCtx := errgroup.WithContext(ctx)
+
+	return &supervisor{
+		ctx:    groupCtx,
+		cancel: cancel,
+		group:  group,
+		done:   make(chan struct{}),
+	}
+}
+
+// Runs f unless the supervisor is stopping, in which case it returns false.
+func (self *supervisor) Go(f func() error) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.ctx.Err() != nil {
+		return false
+	}
+
+	self.group.Go(f)
+	return true
+}
+
+// Once stopped, shutdown is called to release whatever the goroutines block
+// on, and finished with the first error once all of them returned.
+func (self *supervisor) Start(shutdown func(), finished func(err error)) {
+	self.group.Go(func() error {
+		<-self.ctx.Done()
+
+		// Go does not start anything from here on
+		self.mutex.Lock()
+		self.mutex.Unlock()
+
+		shutdown()
+		return nil
+	})
+
+	go func() {
+		self.err = self.group.Wait()
+		self.cancel()
+		close(self.done)
+		finished(self.err)
+	}()
+}
+
+func (self *supervisor) Stop() {
+	self.cancel()
+}
+
+func (self *supervisor) IsRunning() bool {
+	return self.ctx.Err() == nil
+}
+
+// Waits for every goroutine to return. Returns the first error.
+func (self *supervisor) Wait() error {
+	<-self.done
+	return self.err
+}
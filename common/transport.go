@@ -0,0 +1,17 @@
+package common
+
+import (
+	"net"
+
+	"github.com/rsrdesarrollo/tunneler/messages"
+)
+
+// Transport carries session messages between tunnelerc and tunnelerd. A
+// transport is used by one sender and one receiver at a time, while Close
+// can be called at any time.
+type Transport interface {
+	SendMessage(msg *messages.Message) error
+	ReceiveMessage() (*messages.Message, error)
+	Close() error
+	RemoteAddr() net.Addr
+}
@@ -0,0 +1,159 @@
+package common
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/rsrdesarrollo/tunneler/messages"
+)
+
+var transferSizes = []int{64, 16 * 1024, 1024 * 1024}
+
+// Websocket transports connected over loopback, client first.
+func websocketPair(tb testing.TB) (*WebsocketTransport, *WebsocketTransport) {
+	tb.Helper()
+
+	accepted := make(chan *WebsocketTransport, 1)
+	upgrader := websocket.Upgrader{Subprotocols: []string{messages.BinaryCodecName}}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			tb.Error(err)
+			return
+		}
+		accepted <- NewWebsocketTransport(conn)
+	}))
+	tb.Cleanup(server.Close)
+
+	dialer := websocket.Dialer{Subprotocols: []string{messages.BinaryCodecName}}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	client := NewWebsocketTransport(conn)
+	serverSide := <-accepted
+
+	tb.Cleanup(func() {
+		client.Close()
+		serverSide.Close()
+	})
+
+	return client, serverSide
+}
+
+// Noise transports over a websocket pair, client first.
+func noisePair(tb testing.TB) (*NoiseTransport, *NoiseTransport) {
+	tb.Helper()
+
+	client, server := websocketPair(tb)
+	psk := sha256.Sum256([]byte("secret"))
+	encryption := Encryption{Secret: psk[:]}
+
+	accepted := make(chan *NoiseTransport, 1)
+	go func() {
+		request, err := server.ReceiveMessage()
+		if err != nil {
+			tb.Error(err)
+			accepted <- nil
+			return
+		}
+
+		transport, err := AcceptNoiseTransport(server, request, encryption)
+		if err != nil {
+			tb.Error(err)
+		}
+		accepted <- transport
+	}()
+
+	noiseClient, err := DialNoiseTransport(client, encryption)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	noiseServer := <-accepted
+	if noiseServer == nil {
+		tb.FailNow()
+	}
+
+	return noiseClient, noiseServer
+}
+
+func TestNoiseTransportRoundTrip(t *testing.T) {
+	client, server := noisePair(t)
+
+	for _, msg := range []*messages.Message{
+		messages.DataMessage("1", "2", bytes.Repeat([]byte("data"), 1000)),
+		messages.CreateLocalTunnelMessage("1", "tcp", "127.0.0.1:22", "", ""),
+		messages.CloseMessage("1", "2"),
+	} {
+		if err := client.SendMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+
+		received, err := server.ReceiveMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if received.Type != msg.Type || received.Service != msg.Service || !bytes.Equal(received.Data, msg.Data) {
+			t.Errorf("received %+v, expected %+v", received, msg)
+		}
+	}
+}
+
+// Data messages sent from one end of a loopback transport to the other. Run
+// with -benchmem, allocs/op are those of both ends.
+func benchmarkTransfer(b *testing.B, sender Transport, receiver Transport, size int) {
+	msg := messages.DataMessage("1", "2", bytes.Repeat([]byte{0xaa}, size))
+
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < b.N; i++ {
+			if _, err := receiver.ReceiveMessage(); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	b.ReportAllocs()
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := sender.SendMessage(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	if err := <-done; err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkWebsocketTransfer(b *testing.B) {
+	for _, size := range transferSizes {
+		b.Run(fmt.Sprintf("%dB", size), func(b *testing.B) {
+			client, server := websocketPair(b)
+			benchmarkTransfer(b, client, server, size)
+		})
+	}
+}
+
+func BenchmarkNoiseTransfer(b *testing.B) {
+	for _, size := range transferSizes {
+		b.Run(fmt.Sprintf("%dB", size), func(b *testing.B) {
+			client, server := noisePair(b)
+			benchmarkTransfer(b, client, server, size)
+		})
+	}
+}
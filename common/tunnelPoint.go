@@ -1,7 +1,27 @@
 package common
 
+// Settings of a tunnel agreed on its handshake
+type TunnelOptions struct {
+	// Compression of the Data payloads, see messages.Compression
+	Compression string
+	// Scheduling class of the clients, see messages.Priority
+	Priority string
+	// Where exit points may connect, anywhere if nil
+	Destinations *DestinationPolicy
+	// Where entry points may listen, anywhere if nil
+	Binds *BindPolicy
+}
+
 type TunnelPoint interface {
+	// Sends data read from the client. data comes from messages.GetBuffer
+	// and belongs to the tunnel point from then on.
 	ReceiveDataFromClientSocket(client *Client, data []byte)
+	ReceiveEOFFromClientSocket(client *Client)
+	// Gives the peer credit to send more data of the client
+	SendWindowUpdate(client *Client, credit uint32)
+	// Largest Data payload the peer accepts
+	MaxPayloadSize() int
 	CloseClient(clientId string)
-	IsOpen() bool
+	// Closes the client abruptly and lets the peer know why
+	ResetClient(clientId string, code string, err error)
 }
@@ -0,0 +1,126 @@
+package common
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rsrdesarrollo/tunneler/messages"
+)
+
+// Biggest payload a single UDP datagram can carry.
+const maxDatagramSize = 65535
+
+var errSessionClosed = errors.New("udp session closed")
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "udp session i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// UdpSession is a net.Conn view of a single peer talking to a shared
+// PacketConn. Every Read returns exactly one datagram so message boundaries
+// are kept when forwarded through the tunnel.
+type UdpSession struct {
+	packetConn net.PacketConn
+	peer       net.Addr
+	incoming   chan []byte
+	closed     chan struct{}
+
+	mutex        sync.Mutex
+	closeOnce    sync.Once
+	readDeadline time.Time
+}
+
+func NewUdpSession(packetConn net.PacketConn, peer net.Addr) *UdpSession {
+	return &UdpSession{
+		packetConn: packetConn,
+		peer:       peer,
+		incoming:   make(chan []byte, 64),
+		closed:     make(chan struct{}),
+	}
+}
+
+// Deliver queues a datagram received from the peer. Datagrams are dropped
+// if the session is closed or the queue is full, as UDP would do. Queued
+// datagrams come from messages.GetBuffer and go back to the pool once read.
+func (self *UdpSession) Deliver(datagram []byte) bool {
+	select {
+	case <-self.closed:
+		return false
+	default:
+	}
+
+	select {
+	case self.incoming <- datagram:
+		return true
+	default:
+		return false
+	}
+}
+
+func (self *UdpSession) Read(buffer []byte) (int, error) {
+	self.mutex.Lock()
+	deadline := self.readDeadline
+	self.mutex.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case datagram := <-self.incoming:
+		readLen := copy(buffer, datagram)
+		messages.PutBuffer(datagram)
+		return readLen, nil
+	case <-self.closed:
+		return 0, errSessionClosed
+	case <-timeout:
+		return 0, timeoutError{}
+	}
+}
+
+func (self *UdpSession) Write(datagram []byte) (int, error) {
+	select {
+	case <-self.closed:
+		return 0, errSessionClosed
+	default:
+	}
+
+	return self.packetConn.WriteTo(datagram, self.peer)
+}
+
+func (self *UdpSession) Close() error {
+	self.closeOnce.Do(func() {
+		close(self.closed)
+	})
+	return nil
+}
+
+func (self *UdpSession) LocalAddr() net.Addr {
+	return self.packetConn.LocalAddr()
+}
+
+func (self *UdpSession) RemoteAddr() net.Addr {
+	return self.peer
+}
+
+func (self *UdpSession) SetDeadline(t time.Time) error {
+	return self.SetReadDeadline(t)
+}
+
+func (self *UdpSession) SetReadDeadline(t time.Time) error {
+	self.mutex.Lock()
+	self.readDeadline = t
+	self.mutex.Unlock()
+	return nil
+}
+
+func (self *UdpSession) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,282 @@
+package common
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/log4go"
+	"github.com/gorilla/websocket"
+	"github.com/rsrdesarrollo/tunneler/messages"
+)
+
+// Transport over a gorilla websocket. Messages are encoded with the codec
+// negotiated as websocket subprotocol, JSON for peers that negotiate none.
+type WebsocketTransport struct {
+	conn  *websocket.Conn
+	codec messages.Codec
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	readLimit int
+
+	// Keepalive state. Pings carry a sequence number the pong echoes back.
+	mutex        sync.Mutex
+	log          log4go.Logger
+	err          error
+	writeTimeout time.Duration
+	pingSeq      uint64
+	pingSent     time.Time
+	pongSeq      uint64
+	missedPongs  int
+	rtt          time.Duration
+	logRtt       bool
+	rttLogged    time.Duration
+}
+
+// Smallest RTT change logged at Info, along with changes of half the RTT
+const rttLogMinChange = 5 * time.Millisecond
+
+func NewWebsocketTransport(conn *websocket.Conn) *WebsocketTransport {
+	codec, err := messages.CodecByName(conn.Subprotocol())
+
+	if err != nil {
+		codec = messages.JsonCodec
+	}
+
+	return &WebsocketTransport{
+		conn:   conn,
+		codec:  codec,
+		closed: make(chan struct{}),
+	}
+}
+
+// Websocket subprotocols for the given codec, and the ones less preferred.
+func WebsocketSubprotocols(preferred string) []string {
+	var subprotocols []string
+
+	for _, codec := range messages.Codecs {
+		if codec.Name() == preferred || len(subprotocols) > 0 {
+			subprotocols = append(subprotocols, codec.Name())
+		}
+	}
+
+	return subprotocols
+}
+
+func (self *WebsocketTransport) Codec() messages.Codec {
+	return self.codec
+}
+
+func (self *WebsocketTransport) SendMessage(msg *messages.Message) error {
+	// Written out before WriteMessage returns, so the buffer is reused
+	buffer := messages.GetFrameBuffer()
+	defer messages.PutFrameBuffer(buffer)
+
+	data, err := self.codec.Append(*buffer, msg)
+
+	if err != nil {
+		return err
+	}
+	*buffer = data
+
+	messageType := websocket.TextMessage
+	if self.codec.Binary() {
+		messageType = websocket.BinaryMessage
+	}
+
+	self.mutex.Lock()
+	writeTimeout := self.writeTimeout
+	self.mutex.Unlock()
+
+	if writeTimeout > 0 {
+		self.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	}
+
+	err = self.conn.WriteMessage(messageType, data)
+
+	if err != nil {
+		return self.failure(err)
+	}
+	return nil
+}
+
+// Messages over limit bytes fail the transport with ErrFrameTooLarge.
+func (self *WebsocketTransport) SetReadLimit(limit int) {
+	self.readLimit = limit
+	self.conn.SetReadLimit(int64(limit))
+}
+
+func (self *WebsocketTransport) ReceiveMessage() (*messages.Message, error) {
+	_, data, err := self.conn.ReadMessage()
+
+	if err == websocket.ErrReadLimit {
+		return nil, fmt.Errorf("%w: peer sent a message over the %d bytes limit", ErrFrameTooLarge, self.readLimit)
+	}
+
+	if err != nil {
+		return nil, self.failure(err)
+	}
+
+	msg := messages.New()
+
+	err = self.codec.Unmarshal(data, msg)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+func (self *WebsocketTransport) Close() error {
+	self.closeOnce.Do(func() {
+		close(self.closed)
+	})
+	return self.conn.Close()
+}
+
+// Starts pinging the peer, closing the transport if it stops answering, and
+// limits how long writes can take.
+func (self *WebsocketTransport) StartKeepalive(keepalive Keepalive, log log4go.Logger) {
+	self.mutex.Lock()
+	self.log = log
+	self.writeTimeout = keepalive.WriteTimeout
+	self.logRtt = keepalive.LogRtt
+	self.mutex.Unlock()
+
+	if keepalive.PingInterval <= 0 {
+		return
+	}
+
+	self.conn.SetPongHandler(self.pong)
+
+	go self.pinger(keepalive)
+}
+
+func (self *WebsocketTransport) pinger(keepalive Keepalive) {
+	ticker := time.NewTicker(keepalive.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-self.closed:
+			return
+		}
+
+		self.mutex.Lock()
+		self.pingSeq++
+		seq := self.pingSeq
+		self.pingSent = time.Now()
+		self.mutex.Unlock()
+
+		payload := make([]byte, 8)
+		binary.BigEndian.PutUint64(payload, seq)
+
+		err := self.conn.WriteControl(websocket.PingMessage, payload, time.Now().Add(keepalive.PongTimeout))
+
+		if err != nil {
+			self.fail(err)
+			return
+		}
+
+		time.AfterFunc(keepalive.PongTimeout, func() {
+			self.checkPong(seq, keepalive.MaxMissedPongs)
+		})
+	}
+}
+
+// Called by the reader on every pong. Any pong proves the peer alive, the
+// RTT is only measured with the pong of the last ping.
+func (self *WebsocketTransport) pong(data string) error {
+	if len(data) != 8 {
+		return nil
+	}
+
+	seq := binary.BigEndian.Uint64([]byte(data))
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if seq > self.pongSeq {
+		self.pongSeq = seq
+	}
+	self.missedPongs = 0
+
+	if seq == self.pingSeq {
+		self.rtt = time.Since(self.pingSent)
+
+		if self.logRtt && significantRttChange(self.rttLogged, self.rtt) {
+			self.rttLogged = self.rtt
+			self.log.Info("Websocket %s, rtt %s", self.conn.RemoteAddr(), self.rtt)
+		} else {
+			self.log.Debug("Websocket %s, rtt %s", self.conn.RemoteAddr(), self.rtt)
+		}
+	}
+
+	return nil
+}
+
+func significantRttChange(logged time.Duration, rtt time.Duration) bool {
+	change := rtt - logged
+	if change < 0 {
+		change = -change
+	}
+	return logged == 0 || (change >= rttLogMinChange && 2*change >= logged)
+}
+
+func (self *WebsocketTransport) checkPong(seq uint64, maxMissedPongs int) {
+	self.mutex.Lock()
+	if self.pongSeq >= seq {
+		self.mutex.Unlock()
+		return
+	}
+	self.missedPongs++
+	missedPongs := self.missedPongs
+	self.mutex.Unlock()
+
+	if missedPongs >= maxMissedPongs {
+		self.fail(fmt.Errorf("peer %s missed %d pongs", self.conn.RemoteAddr(), missedPongs))
+		return
+	}
+
+	self.log.Warn("Websocket %s, missed pong (%d of %d)", self.conn.RemoteAddr(), missedPongs, maxMissedPongs)
+}
+
+// Closes the transport, the reader and writer get err.
+func (self *WebsocketTransport) fail(err error) {
+	self.mutex.Lock()
+	if self.err == nil {
+		self.err = err
+	}
+	self.mutex.Unlock()
+
+	self.Close()
+}
+
+// The error that closed the transport, if any, is more meaningful than the
+// one the websocket returns after being closed.
+func (self *WebsocketTransport) failure(err error) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.err != nil {
+		return self.err
+	}
+	return err
+}
+
+// Round trip time of the last pong, 0 until one is received.
+func (self *WebsocketTransport) RTT() time.Duration {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.rtt
+}
+
+func (self *WebsocketTransport) RemoteAddr() net.Addr {
+	return self.conn.RemoteAddr()
+}
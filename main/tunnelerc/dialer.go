@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"github.com/rsrdesarrollo/tunneler/common"
+	"github.com/rsrdesarrollo/tunneler/messages"
+	"github.com/spf13/viper"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Connects to the configured Server, picking the transport by its scheme.
+func dialTransport() (common.Transport, error) {
+	server, err := url.Parse(viper.GetString("Server"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch server.Scheme {
+	case "ws", "wss":
+		transport, err := dialWebsocket()
+
+		if err == websocket.ErrBadHandshake {
+			logger.Warn("Websocket upgrade refused, falling back to HTTP long polling")
+			return dialPoll(pollEndpoint(server))
+		}
+
+		return transport, err
+	case "http", "https":
+		return dialPoll(server.String())
+	case "grpc", "grpcs":
+		return dialGrpc(server)
+	default:
+		return nil, &handshakeError{fmt.Sprintf("unsupported server scheme %s", server.Scheme)}
+	}
+}
+
+// A refused encryption handshake won't succeed by retrying. Transport
+// errors are retried.
+func encryptionFailure(err error) error {
+	if errors.Is(err, common.ErrNoiseHandshake) {
+		return &handshakeError{err.Error()}
+	}
+	return handshakeFailure(err)
+}
+
+// gRPC reports authorization failures on the first read of the stream.
+func handshakeFailure(err error) error {
+	if status.Code(err) == codes.Unauthenticated {
+		return &handshakeError{"authorization failed"}
+	}
+	return err
+}
+
+func dialGrpc(server *url.URL) (common.Transport, error) {
+	transportCredentials := insecure.NewCredentials()
+
+	if server.Scheme == "grpcs" {
+		transportCredentials = credentials.NewTLS(&tls.Config{
+			ServerName: server.Hostname(),
+		})
+	}
+
+	options := []grpc.DialOption{
+		grpc.WithTransportCredentials(transportCredentials),
+		grpc.WithDefaultCallOptions(
+			grpc.ForceCodec(common.GrpcCodec{}),
+			grpc.MaxCallRecvMsgSize(common.MaxFrameSizeConfig()),
+		),
+	}
+
+	if keepaliveConfig := common.KeepaliveConfig(); keepaliveConfig.PingInterval > 0 {
+		options = append(options, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                keepaliveConfig.PingInterval,
+			Timeout:             keepaliveConfig.PongTimeout,
+			PermitWithoutStream: true,
+		}))
+	}
+
+	conn, err := grpc.NewClient(server.Host, options...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(metadata.AppendToOutgoingContext(
+		context.Background(),
+		"authorization", "Bearer "+viper.GetString("Token"),
+	))
+
+	stream, err := conn.NewStream(ctx, &common.GrpcServiceDesc.Streams[0], common.GrpcSessionMethod)
+
+	if err != nil {
+		cancel()
+		conn.Close()
+		return nil, handshakeFailure(err)
+	}
+
+	return common.NewGrpcTransport(stream, func() {
+		cancel()
+		conn.Close()
+	}), nil
+}
+
+func dialWebsocket() (common.Transport, error) {
+	var dialer websocket.Dialer
+
+	codec, err := messages.CodecByName(viper.GetString("Codec"))
+
+	if err != nil {
+		return nil, &handshakeError{err.Error()}
+	}
+
+	subprotocols := common.WebsocketSubprotocols(codec.Name())
+
+	if viper.IsSet("Proxy") {
+		urlProxy, err := url.Parse(viper.GetString("Proxy"))
+
+		if err != nil {
+			return nil, err
+		}
+
+		logger.Info("Using proxy at %s", urlProxy.String())
+
+		dialer = websocket.Dialer{
+			Proxy:           http.ProxyURL(urlProxy),
+			WriteBufferSize: viper.GetInt("WriteBufferSize"),
+			ReadBufferSize:  viper.GetInt("ReadBufferSize"),
+			Subprotocols:    subprotocols,
+
+			EnableCompression: viper.GetBool("WebsocketCompression"),
+		}
+	} else {
+		dialer = websocket.Dialer{
+			WriteBufferSize: viper.GetInt("WriteBufferSize"),
+			ReadBufferSize:  viper.GetInt("ReadBufferSize"),
+			Subprotocols:    subprotocols,
+
+			EnableCompression: viper.GetBool("WebsocketCompression"),
+		}
+	}
+
+	ws, response, err := dialer.Dial(viper.GetString("Server"), http.Header{
+		"Authorization": {"Bearer " + viper.GetString("Token")},
+	})
+
+	if err != nil {
+		if response != nil && response.StatusCode == http.StatusUnauthorized {
+			return nil, &handshakeError{"authorization failed"}
+		}
+		return nil, err
+	}
+
+	transport := common.NewWebsocketTransport(ws)
+	logger.Debug("Websocket using %s codec", transport.Codec().Name())
+
+	transport.SetReadLimit(common.MaxFrameSizeConfig())
+	keepaliveConfig := common.KeepaliveConfig()
+	keepaliveConfig.LogRtt = true
+	transport.StartKeepalive(keepaliveConfig, logger)
+
+	return transport, nil
+}
+
+// Long polling is served next to the websocket endpoint: /ws becomes /poll.
+func pollEndpoint(server *url.URL) string {
+	endpoint := *server
+
+	if endpoint.Scheme == "wss" {
+		endpoint.Scheme = "https"
+	} else {
+		endpoint.Scheme = "http"
+	}
+
+	endpoint.Path = strings.TrimSuffix(endpoint.Path, "/ws") + "/poll"
+
+	return endpoint.String()
+}
+
+func dialPoll(endpoint string) (common.Transport, error) {
+	jar, err := cookiejar.New(nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	httpTransport := &http.Transport{}
+
+	if viper.IsSet("Proxy") {
+		urlProxy, err := url.Parse(viper.GetString("Proxy"))
+
+		if err != nil {
+			return nil, err
+		}
+
+		httpTransport.Proxy = http.ProxyURL(urlProxy)
+	}
+
+	transport, response, err := common.DialPollTransport(
+		endpoint,
+		http.Header{
+			"Authorization": {"Bearer " + viper.GetString("Token")},
+		},
+		&http.Client{
+			Jar:       jar,
+			Transport: httpTransport,
+		},
+		common.MaxFrameSizeConfig(),
+	)
+
+	if err != nil {
+		if response != nil && response.StatusCode == http.StatusUnauthorized {
+			return nil, &handshakeError{"authorization failed"}
+		}
+		return nil, err
+	}
+
+	logger.Info("Long polling on %s", endpoint)
+
+	return transport, nil
+}
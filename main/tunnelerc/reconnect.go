@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/rsrdesarrollo/tunneler/common"
+	"github.com/spf13/viper"
+)
+
+// Keeps the tunnels up, reconnecting with exponential backoff every time the
+// session is lost, until the user interrupts or the server rejects us.
+func keepConnected(localTunnels []*Tunnel, remoteTunnels []*Tunnel, interrupt chan os.Signal) error {
+	var session *common.Session
+	attempt := 0
+
+	for {
+		// A detached session is resumed, a closed one started again
+		if session != nil && !session.IsOpen() {
+			session = nil
+		}
+
+		var err error
+		session, err = connect(session, localTunnels, remoteTunnels)
+
+		if err == nil {
+			if attempt > 0 {
+				logger.Info("Reconnected to %s after %d attempts", viper.GetString("Server"), attempt)
+			}
+			attempt = 0
+
+			var interrupted bool
+			interrupted, err = serveSession(session, interrupt)
+
+			if interrupted {
+				return nil
+			}
+		}
+
+		if _, ok := err.(*handshakeError); ok || !viper.GetBool("Reconnect") {
+			closeSession(session)
+			return err
+		}
+
+		attempt++
+		maxAttempts := viper.GetInt("ReconnectMaxAttempts")
+
+		if maxAttempts > 0 && attempt > maxAttempts {
+			closeSession(session)
+			return fmt.Errorf("giving up after %d reconnect attempts: %s", maxAttempts, err)
+		}
+
+		delay := reconnectDelay(attempt)
+		logger.Warn("Disconnected from server (%s). Reconnect attempt %d in %s", err, attempt, delay)
+
+		select {
+		case <-time.After(delay):
+		case <-interrupt:
+			closeSession(session)
+			return nil
+		}
+	}
+}
+
+func closeSession(session *common.Session) {
+	if session != nil {
+		session.CloseSession()
+	}
+}
+
+// Exponential backoff with equal jitter: a random delay between half and the
+// whole of the exponential step, capped at ReconnectMaxDelay.
+func reconnectDelay(attempt int) time.Duration {
+	initialDelay := viper.GetDuration("ReconnectInitialDelay")
+	maxDelay := viper.GetDuration("ReconnectMaxDelay")
+
+	delay := initialDelay
+	for i := 1; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+
+	half := int64(delay / 2)
+	if half <= 0 {
+		return delay
+	}
+	return time.Duration(half + rand.Int63n(half+1))
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/rsrdesarrollo/tunneler/common"
+	"github.com/rsrdesarrollo/tunneler/messages"
+)
+
+// Servers that predate Hello answer it as an unexpected tunnel handshake
+const legacyHelloResponse = "protocol mismatch"
+
+// Announces our versions and features. Returns the Hello of the server, or
+// nil if the server speaks the legacy protocol.
+func sayHello(transport common.Transport) (*messages.Message, error) {
+	features := append(common.Features(), messages.MaxFrameSizeFeature(common.MaxFrameSizeConfig()))
+
+	err := transport.SendMessage(messages.HelloMessage(messages.ProtocolVersion, version, features))
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := transport.ReceiveMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	if response.Type == messages.MessageType.Error {
+		if response.Description == legacyHelloResponse {
+			logger.Warn("Server does not support Hello, falling back to the legacy protocol")
+			return nil, nil
+		}
+		return nil, &handshakeError{response.Description}
+	} else if response.Type != messages.MessageType.Hello {
+		return nil, errors.New("protocol mistmach")
+	}
+
+	if response.ProtocolVersion < messages.MinProtocolVersion || response.ProtocolVersion > messages.ProtocolVersion {
+		return nil, &handshakeError{fmt.Sprintf("server speaks unsupported protocol version %d", response.ProtocolVersion)}
+	}
+
+	logger.Info("Server version %s, protocol %d, features %v", response.Version, response.ProtocolVersion, response.Features)
+
+	return response, nil
+}
+
+// Opens a new session on the transport. Only sessions that will be
+// reconnected ask the server for a resumable session.
+func openSession(transport common.Transport, resumable bool) (*common.Session, error) {
+	sessionId := ""
+
+	if resumable {
+		err := transport.SendMessage(messages.OpenSessionMessage())
+		if err != nil {
+			return nil, err
+		}
+
+		response, err := transport.ReceiveMessage()
+		if err != nil {
+			return nil, err
+		}
+
+		if response.Type == messages.MessageType.Error {
+			return nil, &handshakeError{response.Description}
+		} else if response.Type != messages.MessageType.SessionReady {
+			return nil, errors.New("protocol mistmach")
+		}
+
+		sessionId = response.SessionId
+		logger.Info("Session %s opened", sessionId)
+	}
+
+	session := common.NewSession(sessionId, handleControlMessage, logger)
+	session.MaxFrameSize = common.MaxFrameSizeConfig()
+
+	_, err := session.Attach(transport, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// Tries to attach the transport to a detached session. Returns false if the
+// server does not know the session anymore.
+func resumeSession(transport common.Transport, session *common.Session) (bool, error) {
+	err := transport.SendMessage(messages.ResumeSessionMessage(session.Id, session.ReceivedSeq()))
+	if err != nil {
+		return false, err
+	}
+
+	response, err := transport.ReceiveMessage()
+	if err != nil {
+		return false, err
+	}
+
+	if response.Type == messages.MessageType.Error {
+		logger.Warn("Session %s, %s", session.Id, response.Description)
+		return false, nil
+	} else if response.Type != messages.MessageType.SessionResumed {
+		return false, errors.New("protocol mistmach")
+	}
+
+	_, err = session.Attach(transport, response.Ack)
+	if err != nil {
+		return false, err
+	}
+
+	logger.Info("Session %s resumed", session.Id)
+	return true, nil
+}
@@ -1,30 +1,30 @@
 package main
 
 import (
-	log "github.com/alecthomas/log4go"
-	flags "github.com/jessevdk/go-flags"
-
 	"errors"
+	"fmt"
+	"os"
+	"os/signal"
 
-	"github.com/gorilla/websocket"
+	log "github.com/alecthomas/log4go"
+	flags "github.com/jessevdk/go-flags"
 	"github.com/pkg/profile"
 	"github.com/rsrdesarrollo/tunneler/aux"
+	"github.com/rsrdesarrollo/tunneler/common"
+	"github.com/rsrdesarrollo/tunneler/messages"
 	"github.com/spf13/viper"
-	"net/http"
-	"net/url"
-	"fmt"
-	"os"
 )
 
 var logger log.Logger
 var version = "undefined"
+var encryption common.Encryption
 
 var options struct {
-	PrintVersion  bool   `long:"version" description:"print version and exit"`
-	RemoteTunnel string `short:"R" description:"remote tunnel address"`
-	LocalTunnel  string `short:"L" description:"local tunnel address"`
-	Profile      bool   `long:"profile" description:"profile application"`
-	Protocol     string `short:"p" description:"tunnel protocol (tcp/udp)" default:"tcp" choice:"tcp" choice:"udp"`
+	PrintVersion bool     `long:"version" description:"print version and exit"`
+	RemoteTunnel []string `short:"R" description:"remote tunnel address (repeatable)"`
+	LocalTunnel  []string `short:"L" description:"local tunnel address (repeatable)"`
+	Profile      bool     `long:"profile" description:"profile application"`
+	Protocol     string   `short:"p" description:"tunnel protocol (tcp/udp)" default:"tcp" choice:"tcp" choice:"udp"`
 }
 
 func main() {
@@ -50,7 +50,7 @@ func main() {
 func initialize() error {
 	flags.Parse(&options)
 
-	if options.PrintVersion{
+	if options.PrintVersion {
 		fmt.Printf("Version: %s\n", version)
 		os.Exit(0)
 	}
@@ -61,7 +61,10 @@ func initialize() error {
 		return errors.New("need to specify Token in configuration")
 	}
 
-	return nil
+	var err error
+	encryption, err = common.EncryptionConfig()
+
+	return err
 }
 
 func run() error {
@@ -69,69 +72,129 @@ func run() error {
 		defer profile.Start().Stop()
 	}
 
-	if options.RemoteTunnel != "" && options.LocalTunnel != "" {
-		return errors.New("unable to create local and remote tunnel at the same time")
+	if len(options.RemoteTunnel) == 0 && len(options.LocalTunnel) == 0 {
+		return errors.New("need at least one type of tunnel")
 	}
 
-	var dialer websocket.Dialer
+	var localTunnels, remoteTunnels []*Tunnel
 
-	if viper.IsSet("Proxy") {
-		urlProxy, err := url.Parse(viper.GetString("Proxy"))
+	for i, tunnelStr := range options.LocalTunnel {
+		tunnel, err := parseTunnelString(fmt.Sprintf("L%d", i+1), options.Protocol, tunnelStr)
+		if err != nil {
+			return err
+		}
+		localTunnels = append(localTunnels, tunnel)
+	}
 
+	for i, tunnelStr := range options.RemoteTunnel {
+		tunnel, err := parseTunnelString(fmt.Sprintf("R%d", i+1), options.Protocol, tunnelStr)
 		if err != nil {
 			return err
 		}
+		remoteTunnels = append(remoteTunnels, tunnel)
+	}
 
-		logger.Info("Using proxy at %s", urlProxy.String())
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
 
-		dialer = websocket.Dialer{
-			Proxy:           http.ProxyURL(urlProxy),
-			WriteBufferSize: viper.GetInt("WriteBufferSize"),
-			ReadBufferSize:  viper.GetInt("ReadBufferSize"),
-		}
-	} else {
-		dialer = websocket.Dialer{
-			WriteBufferSize: viper.GetInt("WriteBufferSize"),
-			ReadBufferSize:  viper.GetInt("ReadBufferSize"),
+	return keepConnected(localTunnels, remoteTunnels, interrupt)
+}
+
+// Dials the server and resumes the previous session, if any, or asks for
+// every tunnel on a new one.
+func connect(previous *common.Session, localTunnels []*Tunnel, remoteTunnels []*Tunnel) (*common.Session, error) {
+	transport, err := dialTransport()
+
+	if err != nil {
+		return previous, err
+	}
+
+	if encryption.ClientEnabled() {
+		noiseTransport, err := common.DialNoiseTransport(transport, encryption)
+
+		if err != nil {
+			transport.Close()
+			return previous, encryptionFailure(err)
 		}
+
+		logger.Debug("Transport encrypted with %s", noiseTransport.Protocol())
+		transport = noiseTransport
 	}
 
-	ws, _, err := dialer.Dial(viper.GetString("Server"), http.Header{
-		"Authorization": {"Bearer " + viper.GetString("Token")},
-	})
+	hello, err := sayHello(transport)
 
 	if err != nil {
-		return err
+		transport.Close()
+		return previous, handshakeFailure(err)
 	}
 
-	tunnelStr := options.RemoteTunnel
-	if tunnelStr == "" {
-		tunnelStr = options.LocalTunnel
+	err = checkFeatures(hello, localTunnels, remoteTunnels)
+
+	if err != nil {
+		transport.Close()
+		return previous, err
 	}
 
-	if options.RemoteTunnel != "" {
-		tunnel, err := parseTunnelString(options.Protocol, tunnelStr)
+	resumable := hello != nil && hello.HasFeature(messages.Feature.Resume)
+
+	if previous != nil && resumable {
+		resumed, err := resumeSession(transport, previous)
+
 		if err != nil {
-			return err
+			transport.Close()
+			return previous, handshakeFailure(err)
 		}
 
-		err = createRemoteTunnel(ws, tunnel)
-		if err != nil {
-			return err
+		if resumed {
+			return previous, nil
 		}
-	} else if options.LocalTunnel != "" {
-		tunnel, err := parseTunnelString(options.Protocol, tunnelStr)
+
+		logger.Warn("Session %s can not be resumed, opening a new one", previous.Id)
+	}
+
+	if previous != nil {
+		previous.CloseSession()
+	}
+
+	session, err := openSession(transport, resumable && viper.GetBool("Reconnect"))
+
+	if err != nil {
+		transport.Close()
+		return nil, handshakeFailure(err)
+	}
+
+	if hello != nil {
+		session.Features = hello.Features
+		session.PeerMaxFrameSize = hello.MaxFrameSize()
+	}
+
+	for _, tunnel := range localTunnels {
+		err = createLocalTunnel(session, tunnel)
 		if err != nil {
-			return err
+			session.CloseSession()
+			return nil, err
 		}
+	}
 
-		err = createLocalTunnel(ws, tunnel)
+	for _, tunnel := range remoteTunnels {
+		err = createRemoteTunnel(session, tunnel)
 		if err != nil {
-			return err
+			session.CloseSession()
+			return nil, err
 		}
-	} else {
-		return errors.New("need at least one type of tunnel")
 	}
 
-	return err
+	return session, nil
+}
+
+// Fails clearly when the server lacks a feature the tunnels need.
+func checkFeatures(hello *messages.Message, localTunnels []*Tunnel, remoteTunnels []*Tunnel) error {
+	for _, tunnels := range [][]*Tunnel{localTunnels, remoteTunnels} {
+		for _, tunnel := range tunnels {
+			if tunnel.Protocol == "udp" && (hello == nil || !hello.HasFeature(messages.Feature.Udp)) {
+				return &handshakeError{"server does not support udp tunnels"}
+			}
+		}
+	}
+	return nil
 }
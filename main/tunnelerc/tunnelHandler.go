@@ -1,99 +1,204 @@
 package main
 
 import (
-	"github.com/rsrdesarrollo/tunneler/messages"
-	"os"
-	"os/signal"
-	"github.com/gorilla/websocket"
-	"github.com/rsrdesarrollo/tunneler/common"
 	"errors"
+	"fmt"
+	"os"
 	"regexp"
+	"strings"
+
+	"github.com/rsrdesarrollo/tunneler/common"
+	"github.com/rsrdesarrollo/tunneler/messages"
+	"github.com/spf13/viper"
 )
 
+// Errors the server answers on handshake. Retrying won't fix them.
+type handshakeError struct {
+	description string
+}
+
+func (self *handshakeError) Error() string {
+	return self.description
+}
+
 type Tunnel struct {
+	Id             string
 	Protocol       string
 	BindService    string
 	ConnectService string
+	Compression    string
+	Priority       string
 }
 
-func parseTunnelString(protocol string, tunnel string) (*Tunnel, error) {
-	tunnelRegex := regexp.MustCompile(`^(?P<BindService>(?:[^:]+:)?[^:]+):(?P<ConnectService>[^:]+:[^:]+)$`)
+// Parses [[bind_address:]port:]host:hostport, optionally followed by
+// ,option=value pairs: compression=zstd|none and
+// priority=interactive|normal|bulk. Without a port, or with port 0, any free
+// port is bound.
+func parseTunnelString(id string, protocol string, tunnel string) (*Tunnel, error) {
+	tunnelRegex := regexp.MustCompile(`^(?:(?P<BindService>(?:[^:]+:)?[^:]+):)?(?P<ConnectService>[^:]+:[^:]+)$`)
 
-	ok := tunnelRegex.MatchString(tunnel)
+	spec := strings.Split(tunnel, ",")
 
-	if ok {
-		match := tunnelRegex.FindStringSubmatch(tunnel)
+	ok := tunnelRegex.MatchString(spec[0])
 
-		return &Tunnel{
-			Protocol:       protocol,
-			BindService:    match[1],
-			ConnectService: match[2],
-		}, nil
-	} else {
+	if !ok {
 		return nil, errors.New("invalid tunnel format")
 	}
-}
 
-func createRemoteTunnel(wsocket *websocket.Conn, tunnel *Tunnel) error {
-	logger.Debug("createRemoteTunnel")
+	match := tunnelRegex.FindStringSubmatch(spec[0])
 
-	exitPoint, err := common.NewExitPoint(wsocket, tunnel.Protocol, tunnel.ConnectService, logger)
+	compression, err := common.ParseCompression(viper.GetString("Compression"))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	exitPoint.WebsocketWritterChannel <- messages.CreateRemoteTunnelMessage(tunnel.Protocol, tunnel.BindService)
-	response := <-exitPoint.WebsocketReaderChannel
+	parsed := &Tunnel{
+		Id:             id,
+		Protocol:       protocol,
+		BindService:    match[1],
+		ConnectService: match[2],
+		Compression:    compression,
+	}
 
-	if response.Type == messages.MessageType.Error {
-		return errors.New(response.Description)
-	} else if response.Type == messages.MessageType.RemoteTunnelReady {
-		logger.Info("Remote tunnel binded on %s://%s", response.Protocol, response.Service)
-	} else {
-		return errors.New("protocol mistmach")
+	// Any free port, assigned by the server on remote tunnels
+	if parsed.BindService == "" {
+		parsed.BindService = "0"
 	}
 
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	go func() {
-		for _ = range c {
-			exitPoint.CloseChannel()
+	for _, option := range spec[1:] {
+		key, value, _ := strings.Cut(option, "=")
+
+		switch key {
+		case "compression":
+			parsed.Compression, err = common.ParseCompression(value)
+			if err != nil {
+				return nil, err
+			}
+		case "priority":
+			parsed.Priority, err = common.ParsePriority(value)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unknown tunnel option %q", key)
 		}
-	}()
+	}
+
+	return parsed, nil
+}
+
+// Options for the tunnel the server supports. Compression is dropped with a
+// warning if the server lacks it. The priority always applies to our side.
+func (self *Tunnel) options(session *common.Session) common.TunnelOptions {
+	options := common.TunnelOptions{
+		Compression: self.Compression,
+		Priority:    self.Priority,
+	}
+
+	if options.Compression == messages.Compression.Zstd && !session.HasFeature(messages.Feature.Zstd) {
+		logger.Warn("Tunnel %s, server does not support zstd compression, sending uncompressed", self.Id)
+		options.Compression = messages.Compression.None
+	}
 
-	<-exitPoint.Done
+	return options
+}
+
+// Servers without priorities can not read them.
+func (self *Tunnel) requestPriority(session *common.Session) string {
+	if self.Priority != messages.Priority.Normal && !session.HasFeature(messages.Feature.Priority) {
+		logger.Warn("Tunnel %s, server does not support priorities, %s only applies to data we send", self.Id, self.Priority)
+		return messages.Priority.Normal
+	}
+	return self.Priority
+}
+
+// Local binds without an address are on loopback, as in ssh.
+func (self *Tunnel) localBindService() string {
+	if !strings.Contains(self.BindService, ":") {
+		return "127.0.0.1:" + self.BindService
+	}
+	return self.BindService
+}
+
+func createRemoteTunnel(session *common.Session, tunnel *Tunnel) error {
+	logger.Debug("createRemoteTunnel")
+
+	options := tunnel.options(session)
+
+	exitPoint, err := common.NewExitPoint(session, tunnel.Id, tunnel.Protocol, tunnel.ConnectService, options, logger)
+	if err != nil {
+		return err
+	}
+
+	session.AddTunnel(tunnel.Id, exitPoint, messages.MessageType.CloseRemoteTunnel)
+	session.Send(messages.CreateRemoteTunnelMessage(tunnel.Id, tunnel.Protocol, tunnel.BindService, options.Compression, tunnel.requestPriority(session)))
 
 	return nil
 }
 
-func createLocalTunnel(wsocket *websocket.Conn, tunnel *Tunnel) error {
+func createLocalTunnel(session *common.Session, tunnel *Tunnel) error {
 	logger.Debug("createLocalTunnel")
 
-	entryPoint, err := common.NewEntryPoint(wsocket, tunnel.Protocol, tunnel.BindService, logger)
+	options := tunnel.options(session)
+
+	entryPoint, err := common.NewEntryPoint(session, tunnel.Id, tunnel.Protocol, tunnel.localBindService(), options, logger)
 	if err != nil {
 		return err
 	}
 
-	entryPoint.WebsocketWritterChannel <- messages.CreateLocalTunnelMessage(tunnel.Protocol, tunnel.ConnectService)
-	response := <-entryPoint.WebsocketReaderChannel
+	session.AddTunnel(tunnel.Id, entryPoint, messages.MessageType.CloseLocalTunnel)
+	session.Send(messages.CreateLocalTunnelMessage(tunnel.Id, tunnel.Protocol, tunnel.ConnectService, options.Compression, tunnel.requestPriority(session)))
 
-	if response.Type == messages.MessageType.Error {
-		return errors.New(response.Description)
-	} else if response.Type == messages.MessageType.LocalTunnelReady {
-		logger.Info("Local tunnel binded on %s://%s", response.Protocol, response.Service)
-	} else {
-		return errors.New("protocol mistmach")
-	}
+	return nil
+}
 
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	go func() {
-		for _ = range c {
-			entryPoint.CloseChannel()
+// Handles the server responses to the tunnel requests.
+func handleControlMessage(session *common.Session, response *messages.Message) {
+	switch response.Type {
+	case messages.MessageType.Error:
+		if response.TunnelId == "" {
+			session.TerminateSession(&handshakeError{response.Description})
+			return
 		}
-	}()
 
-	<-entryPoint.Done
+		logger.Error("Tunnel %s, %s", response.TunnelId, response.Description)
+		session.CloseTunnel(response.TunnelId)
 
-	return nil
+		if session.TunnelCount() == 0 {
+			session.TerminateSession(&handshakeError{"no tunnel left open"})
+		}
+
+	case messages.MessageType.LocalTunnelReady:
+		logger.Info("Tunnel %s, local tunnel binded on %s://%s", response.TunnelId, response.Protocol, response.Service)
+		logCompression(response)
+
+	case messages.MessageType.RemoteTunnelReady:
+		logger.Info("Tunnel %s, remote tunnel binded on %s://%s", response.TunnelId, response.Protocol, response.Service)
+		logCompression(response)
+
+	default:
+		logger.Warn("Tunnel %s, protocol mistmach on %s message", response.TunnelId, response.Type)
+	}
+}
+
+func logCompression(response *messages.Message) {
+	if response.Compression != messages.Compression.None {
+		logger.Info("Tunnel %s, %s compression", response.TunnelId, response.Compression)
+	}
+}
+
+// Waits until the session ends or gets detached, either by an error or by
+// the user.
+func serveSession(session *common.Session, interrupt chan os.Signal) (bool, error) {
+	select {
+	case <-session.Done:
+		return false, session.Err()
+
+	case err := <-session.Detached:
+		return false, err
+
+	case <-interrupt:
+		session.CloseSession()
+		return true, nil
+	}
 }
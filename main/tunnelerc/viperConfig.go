@@ -1,8 +1,10 @@
 package main
 
 import (
-	"github.com/spf13/viper"
 	"fmt"
+
+	"github.com/rsrdesarrollo/tunneler/messages"
+	"github.com/spf13/viper"
 )
 
 func configureViper() {
@@ -13,8 +15,24 @@ func configureViper() {
 	viper.SetDefault("ReadBufferSize", 40960)
 	viper.SetDefault("WriteBufferSize", 40960)
 	viper.SetDefault("ClientSocketBuffer", 40960)
+	viper.SetDefault("MaxFrameSize", 1048576)
+	viper.SetDefault("ClientWindowSize", 262144)
+	viper.SetDefault("ClientQueueLimit", 1048576)
+	viper.SetDefault("ClientQueueOverflow", "block")
+	viper.SetDefault("UdpIdleTimeout", "60s")
+	viper.SetDefault("PingInterval", "30s")
+	viper.SetDefault("PongTimeout", "10s")
+	viper.SetDefault("MaxMissedPongs", 3)
+	viper.SetDefault("WriteTimeout", "30s")
+	viper.SetDefault("WebsocketCompression", false)
+	viper.SetDefault("Compression", "none")
 
 	viper.SetDefault("Server", "ws://127.0.0.1:9000")
+	viper.SetDefault("Codec", messages.BinaryCodecName)
+	viper.SetDefault("Reconnect", true)
+	viper.SetDefault("ReconnectMaxAttempts", 0)
+	viper.SetDefault("ReconnectInitialDelay", "1s")
+	viper.SetDefault("ReconnectMaxDelay", "60s")
 	viper.BindEnv("HttpProxy", "http_proxy")
 	viper.RegisterAlias("Proxy", "HttpProxy")
 
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/rsrdesarrollo/tunneler/common"
+	"github.com/rsrdesarrollo/tunneler/messages"
+)
+
+const (
+	directionLocal  = "local"
+	directionRemote = "remote"
+)
+
+// Tunnels a token may create. Empty fields do not limit.
+type tunnelScope struct {
+	Directions []string `json:"directions,omitempty"`
+	// Rules as in AllowDestinations, for local tunnels
+	Destinations []string `json:"destinations,omitempty"`
+	// Port ranges as in RemoteBindPorts, for remote tunnels
+	BindPorts  []string `json:"bind_ports,omitempty"`
+	Protocols  []string `json:"protocols,omitempty"`
+	MaxTunnels int      `json:"max_tunnels,omitempty"`
+}
+
+type tunnelClaims struct {
+	jwt.StandardClaims
+	tunnelScope
+}
+
+// What the sessions opened with a token may do. The scope of the token
+// narrows down the policies of the server.
+type sessionGrants struct {
+	token        string
+	scope        tunnelScope
+	destinations *common.DestinationPolicy
+	binds        *common.BindPolicy
+}
+
+func newSessionGrants(token string, scope tunnelScope) (*sessionGrants, error) {
+	for _, direction := range scope.Directions {
+		if direction != directionLocal && direction != directionRemote {
+			return nil, fmt.Errorf("unknown direction %q", direction)
+		}
+	}
+
+	for _, protocol := range scope.Protocols {
+		if protocol != "tcp" && protocol != "udp" {
+			return nil, fmt.Errorf("unknown protocol %q", protocol)
+		}
+	}
+
+	if scope.MaxTunnels < 0 {
+		return nil, errors.New("max tunnels must not be negative")
+	}
+
+	narrowedDestinations, err := destinations.Narrow(scope.Destinations)
+	if err != nil {
+		return nil, fmt.Errorf("invalid destinations: %s", err)
+	}
+
+	narrowedBinds, err := binds.Narrow(scope.BindPorts)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bind ports: %s", err)
+	}
+
+	return &sessionGrants{
+		token:        token,
+		scope:        scope,
+		destinations: narrowedDestinations,
+		binds:        narrowedBinds,
+	}, nil
+}
+
+// Checks a tunnel request against the scope of the token, and reserves a
+// tunnel of the token for it. The tunnel is released once closed, or with
+// releaseTunnel if it fails to open.
+func (self *sessionGrants) authorizeTunnel(msg *messages.Message) error {
+	direction := directionLocal
+	if msg.Type == messages.MessageType.CreateRemoteTunnel {
+		direction = directionRemote
+	}
+
+	switch {
+	case !scopeAllows(self.scope.Directions, direction):
+		return fmt.Errorf("token does not allow %s tunnels", direction)
+	case !scopeAllows(self.scope.Protocols, msg.Protocol):
+		return fmt.Errorf("token does not allow %s tunnels", msg.Protocol)
+	}
+
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	if self.scope.MaxTunnels > 0 && sessions.tunnels[self.token] >= self.scope.MaxTunnels {
+		return fmt.Errorf("token allows up to %d tunnels", self.scope.MaxTunnels)
+	}
+	sessions.tunnels[self.token]++
+
+	return nil
+}
+
+func (self *sessionGrants) releaseTunnel() {
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	sessions.tunnels[self.token]--
+	if sessions.tunnels[self.token] <= 0 {
+		delete(sessions.tunnels, self.token)
+	}
+}
+
+func scopeAllows(allowed []string, value string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+
+	for _, candidate := range allowed {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+type grantsKey struct{}
+
+// Grants validToken found on the request.
+func requestGrants(request *http.Request) *sessionGrants {
+	grants, _ := request.Context().Value(grantsKey{}).(*sessionGrants)
+	return grants
+}
+
+func withGrants(request *http.Request, grants *sessionGrants) *http.Request {
+	return request.WithContext(context.WithValue(request.Context(), grantsKey{}, grants))
+}
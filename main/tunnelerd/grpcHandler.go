@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/rsrdesarrollo/tunneler/common"
+	"github.com/spf13/viper"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// gRPC clients do not ping more often than this
+const grpcMinPingInterval = 10 * time.Second
+
+type grpcService struct{}
+
+// Serves a session over the stream, authenticated like websockets with a
+// "Bearer <token>" authorization metadata.
+func (grpcService) ServeSession(stream grpc.ServerStream) error {
+	logger.Debug("ServeSession")
+
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	authorization := md.Get("authorization")
+
+	if len(authorization) != 1 {
+		return status.Error(codes.Unauthenticated, "authorization failed")
+	}
+
+	tokenStr, ok := bearerToken(authorization[0])
+	if !ok {
+		return status.Error(codes.Unauthenticated, "authorization failed")
+	}
+
+	grants, err := authorize(tokenStr)
+	if err != nil {
+		logger.Error(err)
+		return status.Error(codes.Unauthenticated, "authorization failed")
+	}
+
+	serveTransport(common.NewGrpcTransport(stream, nil), grants)
+
+	return nil
+}
+
+func serveGrpc(bindAddress string) error {
+	options := []grpc.ServerOption{
+		grpc.ForceServerCodec(common.GrpcCodec{}),
+		grpc.MaxRecvMsgSize(common.MaxFrameSizeConfig()),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             grpcMinPingInterval,
+			PermitWithoutStream: true,
+		}),
+	}
+
+	if keepaliveConfig := common.KeepaliveConfig(); keepaliveConfig.PingInterval > 0 {
+		options = append(options, grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:    keepaliveConfig.PingInterval,
+			Timeout: keepaliveConfig.PongTimeout,
+		}))
+	}
+
+	if viper.IsSet("GrpcTlsCertificate") {
+		tlsCredentials, err := credentials.NewServerTLSFromFile(
+			viper.GetString("GrpcTlsCertificate"),
+			viper.GetString("GrpcTlsKey"),
+		)
+
+		if err != nil {
+			return err
+		}
+
+		options = append(options, grpc.Creds(tlsCredentials))
+	}
+
+	server := grpc.NewServer(options...)
+	server.RegisterService(&common.GrpcServiceDesc, grpcService{})
+
+	listener, err := net.Listen("tcp", bindAddress)
+
+	if err != nil {
+		return err
+	}
+
+	logger.Info("gRPC listen on address %s.", bindAddress)
+
+	return server.Serve(listener)
+}
@@ -1,15 +1,16 @@
 package main
 
 import (
-	"github.com/dgrijalva/jwt-go"
+	"errors"
 	"net/http"
 	"strings"
 	"time"
+
+	"github.com/dgrijalva/jwt-go"
 	"github.com/spf13/viper"
-	"errors"
 )
 
-func generateToken(username string, expirationTime time.Duration) (string, error) {
+func generateToken(username string, expirationTime time.Duration, scope tunnelScope) (string, error) {
 
 	if viper.GetBool("SecretKey.isRandom") {
 		return "", errors.New("SecretKey is random so token will be useless. Please specify SecretKey on config file")
@@ -23,53 +24,89 @@ func generateToken(username string, expirationTime time.Duration) (string, error
 		return "", errors.New("need to specify a positive expirationTime duration")
 	}
 
+	// Scopes the server could not enforce are refused now
+	if _, err := newSessionGrants("", scope); err != nil {
+		return "", err
+	}
+
 	logger.Info("Generating token for user %s. Expiration time %d days.", username, expirationTime)
 
 	now := time.Now()
-	token := jwt.NewWithClaims(jwt.SigningMethodHS512, jwt.StandardClaims{
-		Issuer:    "tunnelerd",
-		Subject:   username,
-		ExpiresAt: now.Add(expirationTime * 24 * time.Hour).Unix(),
-		IssuedAt:  now.Unix(),
+	token := jwt.NewWithClaims(jwt.SigningMethodHS512, tunnelClaims{
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    "tunnelerd",
+			Subject:   username,
+			ExpiresAt: now.Add(expirationTime * 24 * time.Hour).Unix(),
+			IssuedAt:  now.Unix(),
+		},
+		tunnelScope: scope,
 	})
 
 	tokenStr, err := token.SignedString(secret_key)
 
-	if err != nil{
+	if err != nil {
 		return "", err
 	}
 
 	return tokenStr, nil
 }
 
+// Parses and verifies a token issued by generateToken
+func checkToken(tokenStr string) (*tunnelClaims, error) {
+	claims := &tunnelClaims{}
+	token, err := jwt.ParseWithClaims(tokenStr, claims, func(_ *jwt.Token) (interface{}, error) {
+		return secret_key, nil
+	})
+
+	if err == nil && token.Valid {
+		logger.Debug("Claims: %+v %+v", claims.StandardClaims, claims.tunnelScope)
+		return claims, nil
+	}
+
+	if err == nil {
+		err = errors.New("invalid token")
+	}
+	return nil, err
+}
+
+// Grants of a valid token.
+func authorize(tokenStr string) (*sessionGrants, error) {
+	claims, err := checkToken(tokenStr)
+	if err != nil {
+		return nil, err
+	}
+
+	return newSessionGrants(tokenStr, claims.tunnelScope)
+}
+
+// Extracts the token of a "Bearer <token>" authorization header
+func bearerToken(authorization string) (string, bool) {
+	auth := strings.SplitN(authorization, " ", 2)
+
+	if len(auth) != 2 || auth[0] != "Bearer" {
+		return "", false
+	}
+
+	return auth[1], true
+}
+
 func validToken(callback func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, request *http.Request) {
-		auth := strings.SplitN(
-			request.Header.Get("Authorization"),
-			" ",
-			2,
-		)
+		tokenStr, ok := bearerToken(request.Header.Get("Authorization"))
 
-		if len(auth) != 2 || auth[0] != "Bearer" {
+		if !ok {
 			http.Error(w, "authorization failed", http.StatusUnauthorized)
 			return
 		}
 
-		tokenStr := auth[1]
-
-		token, err := jwt.Parse(tokenStr, func(_ *jwt.Token) (interface{}, error) {
-			return secret_key, nil
-		})
-
-		if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-			logger.Info("Claims: %v", claims)
-			callback(w, request)
+		grants, err := authorize(tokenStr)
 
-		} else {
+		if err != nil {
 			logger.Error(err)
 			http.Error(w, "authorization failed", http.StatusUnauthorized)
 			return
 		}
 
+		callback(w, withGrants(request, grants))
 	}
 }
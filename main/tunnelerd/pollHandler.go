@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rsrdesarrollo/tunneler/common"
+	"github.com/spf13/viper"
+)
+
+const pollCookie = "tunneler_poll"
+
+// Long polling transport, with the grants of the token that opened it. The
+// cookie alone does not authorize, every request must carry the same token.
+type polledTransport struct {
+	transport *common.PollTransport
+	watchdog  *time.Timer
+	grants    *sessionGrants
+}
+
+// Long polling transports by session cookie
+var pollTransports = struct {
+	sync.Mutex
+	byId map[string]*polledTransport
+}{
+	byId: make(map[string]*polledTransport),
+}
+
+// HTTP long polling fallback for clients that can not use websockets. A GET
+// without cookie opens the transport, then GET long-polls messages to the
+// client, POST delivers messages from the client and DELETE closes it.
+func servePoll(w http.ResponseWriter, request *http.Request) {
+	logger.Debug("servePoll")
+
+	cookie, err := request.Cookie(pollCookie)
+
+	if err != nil {
+		if request.Method != http.MethodGet {
+			http.Error(w, "missing poll cookie", http.StatusBadRequest)
+			return
+		}
+		openPollTransport(w, request)
+		return
+	}
+
+	pollTransports.Lock()
+	polled := pollTransports.byId[cookie.Value]
+	pollTransports.Unlock()
+
+	if polled == nil {
+		http.Error(w, "unknown or closed poll transport", http.StatusGone)
+		return
+	}
+
+	if grants := requestGrants(request); grants == nil || polled.grants == nil || grants.token != polled.grants.token {
+		logger.Warn("Poll transport request from %s with another token", request.RemoteAddr)
+		http.Error(w, "poll transport opened with another token", http.StatusForbidden)
+		return
+	}
+
+	polled.watchdog.Reset(viper.GetDuration("PollIdleTimeout"))
+
+	switch request.Method {
+	case http.MethodGet:
+		batch, err := polled.transport.Collect(viper.GetDuration("PollTimeout"))
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusGone)
+			return
+		}
+
+		writePollBatch(w, batch)
+
+	case http.MethodPost:
+		batch, err := polled.transport.DecodeBatch(request.Body)
+
+		if errors.Is(err, common.ErrFrameTooLarge) {
+			polled.transport.Fail(err)
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err = polled.transport.Deliver(batch)
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusGone)
+			return
+		}
+
+		writePollBatch(w, nil)
+
+	case http.MethodDelete:
+		polled.transport.Close()
+		writePollBatch(w, nil)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func openPollTransport(w http.ResponseWriter, request *http.Request) {
+	pollId := common.NewSessionId()
+	remoteAddr, _ := net.ResolveTCPAddr("tcp", request.RemoteAddr)
+
+	transport := common.NewPollServerTransport(remoteAddr, common.MaxFrameSizeConfig())
+
+	// Clients that vanish without a DELETE are dropped after PollIdleTimeout
+	watchdog := time.AfterFunc(viper.GetDuration("PollIdleTimeout"), func() {
+		transport.Fail(errors.New("poll transport idle timeout"))
+	})
+
+	grants := requestGrants(request)
+
+	pollTransports.Lock()
+	pollTransports.byId[pollId] = &polledTransport{
+		transport: transport,
+		watchdog:  watchdog,
+		grants:    grants,
+	}
+	pollTransports.Unlock()
+
+	logger.Debug("Poll transport opened from %s", request.RemoteAddr)
+
+	go func() {
+		serveTransport(transport, grants)
+
+		watchdog.Stop()
+
+		pollTransports.Lock()
+		delete(pollTransports.byId, pollId)
+		pollTransports.Unlock()
+	}()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     pollCookie,
+		Value:    pollId,
+		Path:     "/",
+		HttpOnly: true,
+	})
+
+	writePollBatch(w, nil)
+}
+
+func writePollBatch(w http.ResponseWriter, batch []json.RawMessage) {
+	if batch == nil {
+		batch = []json.RawMessage{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(batch)
+}
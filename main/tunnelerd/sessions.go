@@ -0,0 +1,238 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/rsrdesarrollo/tunneler/common"
+	"github.com/rsrdesarrollo/tunneler/messages"
+	"github.com/spf13/viper"
+)
+
+// Sessions alive or, if resumable, waiting for the client to come back, with
+// the grants of the token that opened them, and the tunnels open or being
+// opened by every token. Only resumable sessions are indexed by id.
+var sessions = struct {
+	sync.Mutex
+	byId    map[string]*common.Session
+	all     map[*common.Session]*sessionGrants
+	tunnels map[string]int
+}{
+	byId:    make(map[string]*common.Session),
+	all:     make(map[*common.Session]*sessionGrants),
+	tunnels: make(map[string]int),
+}
+
+func registerSession(session *common.Session, grants *sessionGrants) {
+	if grants != nil {
+		session.OnTunnelClosed = func(string) { grants.releaseTunnel() }
+	}
+
+	sessions.Lock()
+	if session.Id != "" {
+		sessions.byId[session.Id] = session
+	}
+	sessions.all[session] = grants
+	sessions.Unlock()
+
+	go func() {
+		<-session.Done
+
+		sessions.Lock()
+		if session.Id != "" {
+			delete(sessions.byId, session.Id)
+		}
+		delete(sessions.all, session)
+		sessions.Unlock()
+	}()
+}
+
+func allSessions() []*common.Session {
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	all := make([]*common.Session, 0, len(sessions.all))
+	for session := range sessions.all {
+		all = append(all, session)
+	}
+	return all
+}
+
+// Only the token that opened a session can resume it.
+func lookupSession(sessionId string, grants *sessionGrants) *common.Session {
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	session := sessions.byId[sessionId]
+	if session == nil || grants == nil || sessions.all[session].token != grants.token {
+		return nil
+	}
+	return session
+}
+
+func sessionGrantsOf(session *common.Session) *sessionGrants {
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	return sessions.all[session]
+}
+
+// Serves a session on the transport until it is over or the transport gets
+// detached from it.
+func serveTransport(transport common.Transport, grants *sessionGrants) {
+	defer transport.Close()
+
+	session, lost, err := openSession(transport, grants)
+
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+
+	select {
+	case <-session.Done:
+		if session.Err() != nil {
+			logger.Error(session.Err())
+		}
+		logger.Debug("Session Done.")
+
+	case <-lost:
+		logger.Debug("Session %s detached from %s.", session.Id, transport.RemoteAddr())
+	}
+}
+
+// Agrees on the highest protocol version both peers speak and answers with
+// the features both support and the largest frame we accept. Clients too
+// old or too new get a clear error.
+func answerHello(transport common.Transport, hello *messages.Message) ([]string, error) {
+	logger.Info("Client %s, version %s, protocol %d, features %v",
+		transport.RemoteAddr(), hello.Version, hello.ProtocolVersion, hello.Features)
+
+	protocolVersion := hello.ProtocolVersion
+	if protocolVersion > messages.ProtocolVersion {
+		protocolVersion = messages.ProtocolVersion
+	}
+
+	if protocolVersion < messages.MinProtocolVersion {
+		err := fmt.Errorf("unsupported protocol version %d, server speaks %d to %d",
+			hello.ProtocolVersion, messages.MinProtocolVersion, messages.ProtocolVersion)
+		transport.SendMessage(messages.ErrorMessage(err))
+		return nil, err
+	}
+
+	features := hello.CommonFeatures(common.Features())
+	announced := append(features, messages.MaxFrameSizeFeature(common.MaxFrameSizeConfig()))
+
+	return features, transport.SendMessage(messages.HelloMessage(protocolVersion, version, announced))
+}
+
+// Reads the handshake of a transport, an optional Noise handshake that
+// encrypts the rest, an optional Hello and then a message that opens a new
+// session or resumes an existing one. Clients that do not ask for a session
+// get a non resumable one.
+func openSession(transport common.Transport, grants *sessionGrants) (*common.Session, <-chan struct{}, error) {
+	var features []string
+	var peerMaxFrameSize int
+	encrypted := false
+	greeted := false
+
+	for {
+		msg, err := transport.ReceiveMessage()
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if msg.Type == messages.MessageType.Noise && !encrypted {
+			noiseTransport, err := common.AcceptNoiseTransport(transport, msg, encryption)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			logger.Info("Client %s, encrypted with %s", transport.RemoteAddr(), noiseTransport.Protocol())
+
+			transport = noiseTransport
+			encrypted = true
+			continue
+		}
+
+		if !encrypted && viper.GetBool("RequireEncryption") {
+			err = errors.New("encryption required")
+			transport.SendMessage(messages.ErrorMessage(err))
+			return nil, nil, err
+		}
+
+		switch msg.Type {
+		case messages.MessageType.Hello:
+			features, err = answerHello(transport, msg)
+			if err != nil {
+				return nil, nil, err
+			}
+			peerMaxFrameSize = msg.MaxFrameSize()
+			greeted = true
+
+		case messages.MessageType.OpenSession:
+			session := common.NewSession(common.NewSessionId(), handleControlMessage, logger)
+			session.ResumeTimeout = viper.GetDuration("SessionResumeTimeout")
+			session.Features = features
+			session.MaxFrameSize = common.MaxFrameSizeConfig()
+			session.PeerMaxFrameSize = peerMaxFrameSize
+			registerSession(session, grants)
+
+			logger.Info("Session %s opened from %s", session.Id, transport.RemoteAddr())
+
+			err = transport.SendMessage(messages.SessionReadyMessage(session.Id))
+			if err != nil {
+				session.CloseSession()
+				return nil, nil, err
+			}
+
+			lost, err := session.Attach(transport, 0)
+			return session, lost, err
+
+		case messages.MessageType.ResumeSession:
+			session := lookupSession(msg.SessionId, grants)
+
+			if session == nil {
+				logger.Warn("Unable to resume unknown or expired session %s", msg.SessionId)
+				err = transport.SendMessage(messages.ErrorMessage(errors.New("unknown or expired session")))
+				if err != nil {
+					return nil, nil, err
+				}
+				// The client can still open a new session
+				continue
+			}
+
+			logger.Info("Session %s resumed from %s", session.Id, transport.RemoteAddr())
+
+			err = transport.SendMessage(messages.SessionResumedMessage(session.Id, session.ReceivedSeq()))
+			if err != nil {
+				return nil, nil, err
+			}
+
+			lost, err := session.Attach(transport, msg.Ack)
+			return session, lost, err
+
+		default:
+			session := common.NewSession("", handleControlMessage, logger)
+			session.Features = features
+			session.MaxFrameSize = common.MaxFrameSizeConfig()
+			session.PeerMaxFrameSize = peerMaxFrameSize
+			registerSession(session, grants)
+
+			// Handled before attaching so it goes ahead of any following message
+			if !greeted && msg.TunnelId == "" && isTunnelRequest(msg) {
+				// Clients that predate tunnel ids open one tunnel per
+				// connection, their messages carry no tunnel id
+				logger.Warn("Client %s predates tunnel ids, serving a single legacy tunnel", transport.RemoteAddr())
+				createTunnel(session, msg)
+			} else {
+				handleControlMessage(session, msg)
+			}
+
+			lost, err := session.Attach(transport, 0)
+			return session, lost, err
+		}
+	}
+}
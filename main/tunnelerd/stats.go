@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/rsrdesarrollo/tunneler/common"
+)
+
+// Serves the stats of every session as JSON. It has no authentication, so
+// it is served on its own StatsBindAddress.
+func serveStats(w http.ResponseWriter, request *http.Request) {
+	stats := make([]common.SessionStats, 0)
+
+	for _, session := range allSessions() {
+		stats = append(stats, session.Stats())
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Id < stats[j].Id
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+func listenStats(bindAddress string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", serveStats)
+
+	logger.Info("Stats on address %s.", bindAddress)
+
+	return http.ListenAndServe(bindAddress, mux)
+}
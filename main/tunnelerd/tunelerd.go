@@ -1,32 +1,41 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
-
-	"github.com/pkg/profile"
+	"os"
+	"time"
 
 	log "github.com/alecthomas/log4go"
 	flags "github.com/jessevdk/go-flags"
-
+	"github.com/pkg/profile"
 	"github.com/rsrdesarrollo/tunneler/aux"
-
+	"github.com/rsrdesarrollo/tunneler/common"
 	"github.com/spf13/viper"
-	"time"
-	"errors"
-	"fmt"
-	"os"
 )
 
 var logger log.Logger
 var secret_key []byte
+var encryption common.Encryption
+var destinations *common.DestinationPolicy
+var binds *common.BindPolicy
 var version = "undefined"
 
 var options struct {
-	PrintVersion  bool   `long:"version" description:"print version and exit"`
+	PrintVersion   bool   `long:"version" description:"print version and exit"`
 	Profile        bool   `long:"profile" description:"profile application"`
 	GenerateToken  bool   `long:"generate-token" description:"run token generation for a user and exit"`
 	User           string `short:"u" long:"user" description:"username for the token to be generated"`
 	ExpirationTime int64  `short:"e" long:"expiration" description:"expiration time of the token in days" default:"360"`
+	GenerateKey    bool   `long:"generate-key" description:"generate a static key pair for end to end encryption and exit"`
+
+	// Scope of the token to be generated
+	Directions   []string `long:"direction" description:"direction of the tunnels the token may create, local or remote (repeatable)"`
+	Destinations []string `long:"destination" description:"destination local tunnels of the token may reach, as in AllowDestinations (repeatable)"`
+	BindPorts    []string `long:"bind-ports" description:"port or port range remote tunnels of the token may bind (repeatable)"`
+	Protocols    []string `long:"protocol" description:"protocol of the tunnels the token may create, tcp or udp (repeatable)" choice:"tcp" choice:"udp"`
+	MaxTunnels   int      `long:"max-tunnels" description:"tunnels the token may have open at once, 0 for no limit"`
 }
 
 func main() {
@@ -52,9 +61,16 @@ func main() {
 }
 
 func initialize() error {
-	flags.Parse(&options)
+	if _, err := flags.Parse(&options); err != nil {
+		// Already printed. Never go on with half parsed options, they could
+		// generate a token broader than asked for
+		if flagsErr, ok := err.(*flags.Error); ok && flagsErr.Type == flags.ErrHelp {
+			os.Exit(0)
+		}
+		os.Exit(1)
+	}
 
-	if options.PrintVersion{
+	if options.PrintVersion {
 		fmt.Printf("Version: %s\n", version)
 		os.Exit(0)
 	}
@@ -67,7 +83,26 @@ func initialize() error {
 
 	secret_key = []byte(viper.GetString("SecretKey"))
 
-	return nil
+	var err error
+	encryption, err = common.EncryptionConfig()
+
+	if err != nil {
+		return err
+	}
+
+	destinations, err = common.DestinationPolicyConfig()
+
+	if err != nil {
+		return err
+	}
+
+	binds, err = common.BindPolicyConfig(
+		viper.GetString("BindAddress"),
+		viper.GetString("GrpcBindAddress"),
+		viper.GetString("StatsBindAddress"),
+	)
+
+	return err
 }
 
 func run() error {
@@ -76,8 +111,26 @@ func run() error {
 		defer profile.Start().Stop()
 	}
 
+	if options.GenerateKey {
+		privateKey, publicKey, err := common.GenerateNoiseKey()
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("EncryptionPrivateKey: %s\nEncryptionServerKey: %s\n", privateKey, publicKey)
+
+		return nil
+	}
+
 	if options.GenerateToken {
-		token, err := generateToken(options.User, time.Duration(options.ExpirationTime))
+		token, err := generateToken(options.User, time.Duration(options.ExpirationTime), tunnelScope{
+			Directions:   options.Directions,
+			Destinations: options.Destinations,
+			BindPorts:    options.BindPorts,
+			Protocols:    options.Protocols,
+			MaxTunnels:   options.MaxTunnels,
+		})
 
 		if err != nil {
 			return err
@@ -88,10 +141,31 @@ func run() error {
 		return nil
 	}
 
+	upgrader.EnableCompression = viper.GetBool("WebsocketCompression")
+
 	http.HandleFunc("/ws", validToken(serveWebsocket))
+	http.HandleFunc("/poll", validToken(servePoll))
+
+	serveErrors := make(chan error, 3)
+
+	if viper.GetString("GrpcBindAddress") != "" {
+		go func() {
+			serveErrors <- serveGrpc(viper.GetString("GrpcBindAddress"))
+		}()
+	}
+
+	if viper.GetString("StatsBindAddress") != "" {
+		go func() {
+			serveErrors <- listenStats(viper.GetString("StatsBindAddress"))
+		}()
+	}
 
 	bindAddress := viper.GetString("BindAddress")
 	logger.Info("Listen on address %s.", bindAddress)
 
-	return http.ListenAndServe(bindAddress, nil)
+	go func() {
+		serveErrors <- http.ListenAndServe(bindAddress, nil)
+	}()
+
+	return <-serveErrors
 }
@@ -1,8 +1,9 @@
 package main
 
 import (
-	"github.com/spf13/viper"
 	"fmt"
+
+	"github.com/spf13/viper"
 )
 
 func configureViper() {
@@ -13,8 +14,30 @@ func configureViper() {
 	viper.SetDefault("ReadBufferSize", 40960)
 	viper.SetDefault("WriteBufferSize", 40960)
 	viper.SetDefault("ClientSocketBuffer", 40960)
+	viper.SetDefault("MaxFrameSize", 1048576)
+	viper.SetDefault("ClientWindowSize", 262144)
+	viper.SetDefault("ClientQueueLimit", 1048576)
+	viper.SetDefault("ClientQueueOverflow", "block")
+	viper.SetDefault("UdpIdleTimeout", "60s")
+	viper.SetDefault("PingInterval", "30s")
+	viper.SetDefault("PongTimeout", "10s")
+	viper.SetDefault("MaxMissedPongs", 3)
+	viper.SetDefault("WriteTimeout", "30s")
+	viper.SetDefault("WebsocketCompression", false)
 
 	viper.SetDefault("BindAddress", "127.0.0.1:9000")
+	viper.SetDefault("GrpcBindAddress", "")
+	viper.SetDefault("StatsBindAddress", "")
+	viper.SetDefault("PollTimeout", "25s")
+	viper.SetDefault("PollIdleTimeout", "60s")
+	viper.SetDefault("SessionResumeTimeout", "30s")
+	viper.SetDefault("RequireEncryption", false)
+	viper.SetDefault("AllowDestinations", []string{})
+	viper.SetDefault("DenyDestinations", []string{})
+	viper.SetDefault("RemoteBindAddresses", []string{"127.0.0.1", "::1"})
+	viper.SetDefault("RemoteBindPorts", []string{"1024-65535"})
+	viper.SetDefault("RemoteDynamicPorts", []string{"49152-65535"})
+	viper.SetDefault("ReservedPorts", []string{})
 
 	viper.SetConfigName("config")
 	viper.AddConfigPath("/etc/tunnelerd/")
@@ -1,12 +1,12 @@
 package main
 
 import (
-	"net/http"
 	"errors"
+	"net/http"
 
-	"github.com/rsrdesarrollo/tunneler/messages"
 	"github.com/gorilla/websocket"
 	"github.com/rsrdesarrollo/tunneler/common"
+	"github.com/rsrdesarrollo/tunneler/messages"
 )
 
 var upgrader = websocket.Upgrader{
@@ -15,6 +15,7 @@ var upgrader = websocket.Upgrader{
 	},
 	WriteBufferSize: 40960,
 	ReadBufferSize:  40960,
+	Subprotocols:    common.WebsocketSubprotocols(messages.BinaryCodecName),
 }
 
 func serveWebsocket(w http.ResponseWriter, request *http.Request) {
@@ -27,58 +28,102 @@ func serveWebsocket(w http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	defer ws.Close()
+	transport := common.NewWebsocketTransport(ws)
+	logger.Debug("Websocket from %s using %s codec", ws.RemoteAddr(), transport.Codec().Name())
+
+	transport.SetReadLimit(common.MaxFrameSizeConfig())
+	transport.StartKeepalive(common.KeepaliveConfig(), logger)
+
+	serveTransport(transport, requestGrants(request))
+}
+
+// Handles a tunnel handshake. Every tunnel on the session is created and
+// closed on its own.
+func handleControlMessage(session *common.Session, msg *messages.Message) {
+	logger.Trace("(%s) Readed control message from websocket %#v", msg.TunnelId, msg)
 
-	// Handle tunnel handshake
-	msg := messages.New()
-	err = ws.ReadJSON(msg)
+	if !isTunnelRequest(msg) {
+		session.Send(messages.ErrorMessage(errors.New("protocol mismatch")))
+		return
+	}
 
+	if msg.TunnelId == "" || session.Tunnel(msg.TunnelId) != nil {
+		session.Send(messages.TunnelErrorMessage(msg.TunnelId, errors.New("invalid or duplicated tunnel id")))
+		return
+	}
+
+	createTunnel(session, msg)
+}
+
+func isTunnelRequest(msg *messages.Message) bool {
+	return msg.Type == messages.MessageType.CreateLocalTunnel || msg.Type == messages.MessageType.CreateRemoteTunnel
+}
+
+// Creates the tunnel a request asks for, within the grants of the session.
+func createTunnel(session *common.Session, msg *messages.Message) {
+	grants := sessionGrantsOf(session)
+	if grants == nil {
+		// The session got closed and unregistered meanwhile
+		err := errors.New("session is closed")
+		logger.Warn("(%s) %s", msg.TunnelId, err)
+		session.Send(messages.TunnelErrorMessage(msg.TunnelId, err))
+		return
+	}
+
+	err := grants.authorizeTunnel(msg)
 	if err != nil {
-		logger.Error(err)
+		logger.Warn("(%s) %s", msg.TunnelId, err)
+		session.Send(messages.TunnelErrorMessage(msg.TunnelId, err))
 		return
 	}
 
-	logger.Trace("(%s) Readed message from websocket %#v", "", msg)
+	options := common.TunnelOptions{
+		Compression:  msg.Compression,
+		Priority:     msg.Priority,
+		Destinations: grants.destinations,
+		Binds:        grants.binds,
+	}
 
 	if msg.Type == messages.MessageType.CreateLocalTunnel {
-		logger.Debug("(%s) Client ask to create a Local Tunnel", "")
+		logger.Debug("(%s) Client ask to create a Local Tunnel", msg.TunnelId)
 		exitPoint, err := common.NewExitPoint(
-			ws,
+			session,
+			msg.TunnelId,
 			msg.Protocol,
 			msg.Service,
+			options,
 			logger,
 		)
 
 		if err != nil {
-			//TODO: handle create exit point error
 			logger.Error(err)
+			grants.releaseTunnel()
+			session.Send(messages.TunnelErrorMessage(msg.TunnelId, err))
+			return
 		}
 
-		exitPoint.WebsocketWritterChannel <- messages.LocalTunnelReadyMessage(msg.Protocol, msg.Service)
-
-		<-exitPoint.Done
-		logger.Debug("Local tunnel Done.")
+		session.AddTunnel(msg.TunnelId, exitPoint, messages.MessageType.CloseLocalTunnel)
+		session.Send(messages.LocalTunnelReadyMessage(msg.TunnelId, msg.Protocol, msg.Service, options.Compression))
 
-	} else if msg.Type == messages.MessageType.CreateRemoteTunnel {
-		logger.Debug("(%s) Client ask to create a Remote Tunnel", "")
+	} else {
+		logger.Debug("(%s) Client ask to create a Remote Tunnel", msg.TunnelId)
 		entryPoint, err := common.NewEntryPoint(
-			ws,
+			session,
+			msg.TunnelId,
 			msg.Protocol,
 			msg.Service,
+			options,
 			logger,
 		)
 
 		if err != nil {
-			// TODO: handle create entry point error
 			logger.Error(err)
+			grants.releaseTunnel()
+			session.Send(messages.TunnelErrorMessage(msg.TunnelId, err))
+			return
 		}
 
-		entryPoint.WebsocketWritterChannel <- messages.RemoteTunnelReadyMessage(msg.Protocol, msg.Service)
-
-		<-entryPoint.Done
-		logger.Debug("Remote tunnel Done.")
-
-	} else {
-		ws.WriteJSON(messages.ErrorMessage(errors.New("protocol mismatch")))
+		session.AddTunnel(msg.TunnelId, entryPoint, messages.MessageType.CloseRemoteTunnel)
+		session.Send(messages.RemoteTunnelReadyMessage(msg.TunnelId, msg.Protocol, entryPoint.Service, options.Compression))
 	}
 }
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/alecthomas/log4go"
+	"github.com/gorilla/websocket"
+	"github.com/rsrdesarrollo/tunneler/common"
+	"github.com/rsrdesarrollo/tunneler/messages"
+	"github.com/spf13/viper"
+)
+
+// Echo service that closes once the peer is done writing.
+func echoService(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			connection, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(connection, connection)
+				connection.Close()
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestMain(m *testing.M) {
+	logger = make(log.Logger)
+	viper.Set("ClientSocketBuffer", 4096)
+
+	var err error
+	destinations, err = common.DestinationPolicyConfig()
+	if err != nil {
+		panic(err)
+	}
+
+	os.Exit(m.Run())
+}
+
+// Websocket to a server with the grants of an unscoped token, without
+// subprotocol as clients that predate codecs dial.
+func dialTestServer(t *testing.T) *websocket.Conn {
+	t.Helper()
+
+	grants, err := newSessionGrants("token", tunnelScope{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+		serveWebsocket(w, withGrants(request, grants))
+	}))
+	t.Cleanup(server.Close)
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+
+	ws.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	return ws
+}
+
+// Clients that predate Hello and tunnel ids send a bare CreateLocalTunnel,
+// then Data by client id, an empty payload being the EOF.
+func TestLegacyClientLocalTunnel(t *testing.T) {
+	ws := dialTestServer(t)
+
+	err := ws.WriteJSON(&messages.Message{
+		Type:     messages.MessageType.CreateLocalTunnel,
+		Protocol: "tcp",
+		Service:  echoService(t),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ready messages.Message
+	if err := ws.ReadJSON(&ready); err != nil {
+		t.Fatal(err)
+	}
+	if ready.Type != messages.MessageType.LocalTunnelReady {
+		t.Fatalf("answered %s %q, expected LocalTunnelReady", ready.Type, ready.Description)
+	}
+
+	ws.WriteJSON(&messages.Message{Type: messages.MessageType.Data, ClientId: "1", Data: []byte("hello")})
+	ws.WriteJSON(&messages.Message{Type: messages.MessageType.Data, ClientId: "1"})
+
+	var echoed []byte
+	for {
+		var msg messages.Message
+		if err := ws.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+
+		if msg.Type != messages.MessageType.Data || msg.ClientId != "1" || msg.TunnelId != "" {
+			t.Fatalf("unexpected message %+v", msg)
+		}
+
+		if len(msg.Data) == 0 {
+			break
+		}
+		echoed = append(echoed, msg.Data...)
+	}
+
+	if string(echoed) != "hello" {
+		t.Errorf("echoed %q", echoed)
+	}
+}
+
+// Clients with tunnel ids but without Hello still need valid ids.
+func TestPreHelloClientRequiresTunnelId(t *testing.T) {
+	ws := dialTestServer(t)
+
+	for _, msg := range []*messages.Message{
+		messages.CreateLocalTunnelMessage("1", "tcp", echoService(t), "", ""),
+		messages.CreateLocalTunnelMessage("1", "tcp", echoService(t), "", ""),
+	} {
+		if err := ws.WriteJSON(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, expected := range []string{messages.MessageType.LocalTunnelReady, messages.MessageType.Error} {
+		var response messages.Message
+		if err := ws.ReadJSON(&response); err != nil {
+			t.Fatal(err)
+		}
+		if response.Type != expected || response.TunnelId != "1" {
+			t.Errorf("answered %s for tunnel %q, expected %s", response.Type, response.TunnelId, expected)
+		}
+	}
+}
+
+// A client id opened twice is reset, so neither side keeps the stream.
+func TestDuplicatedOpenIsReset(t *testing.T) {
+	ws := dialTestServer(t)
+
+	hello := messages.HelloMessage(messages.ProtocolVersion, "test", []string{messages.Feature.Streams})
+	if err := ws.WriteJSON(hello); err != nil {
+		t.Fatal(err)
+	}
+
+	var answer messages.Message
+	if err := ws.ReadJSON(&answer); err != nil {
+		t.Fatal(err)
+	}
+	if answer.Type != messages.MessageType.Hello {
+		t.Fatalf("answered %s %q, expected Hello", answer.Type, answer.Description)
+	}
+
+	ws.WriteJSON(messages.CreateLocalTunnelMessage("1", "tcp", echoService(t), "", ""))
+
+	var ready messages.Message
+	if err := ws.ReadJSON(&ready); err != nil {
+		t.Fatal(err)
+	}
+	if ready.Type != messages.MessageType.LocalTunnelReady {
+		t.Fatalf("answered %s %q, expected LocalTunnelReady", ready.Type, ready.Description)
+	}
+
+	ws.WriteJSON(messages.OpenMessage("1", "1"))
+
+	var ack messages.Message
+	if err := ws.ReadJSON(&ack); err != nil {
+		t.Fatal(err)
+	}
+	if ack.Type != messages.MessageType.OpenAck {
+		t.Fatalf("answered %s %q, expected OpenAck", ack.Type, ack.Description)
+	}
+
+	ws.WriteJSON(messages.OpenMessage("1", "1"))
+
+	var reset messages.Message
+	if err := ws.ReadJSON(&reset); err != nil {
+		t.Fatal(err)
+	}
+	if reset.Type != messages.MessageType.Reset || reset.ClientId != "1" || reset.Code != messages.ErrorCode.Protocol {
+		t.Fatalf("answered %+v, expected a protocol Reset", reset)
+	}
+
+	// The first stream is gone too, its data is ignored
+	ws.WriteJSON(messages.DataMessage("1", "1", []byte("hello")))
+	ws.WriteJSON(messages.OpenMessage("1", "2"))
+
+	var next messages.Message
+	if err := ws.ReadJSON(&next); err != nil {
+		t.Fatal(err)
+	}
+	if next.Type != messages.MessageType.OpenAck || next.ClientId != "2" {
+		t.Fatalf("answered %+v, expected OpenAck of client 2", next)
+	}
+}
@@ -0,0 +1,109 @@
+package messages
+
+import (
+	"sync"
+)
+
+// Capacity of pooled payload buffers, enough for a whole datagram. Bigger
+// payloads are allocated as usual.
+const PoolBufferSize = 64 * 1024
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		buffer := make([]byte, PoolBufferSize)
+		return &buffer
+	},
+}
+
+// Encoded frames are built in pooled buffers as well, that grow as needed.
+// The ones that grew over maxPooledFrameBuffer are left to the GC.
+const maxPooledFrameBuffer = 4 * 1024 * 1024
+
+var frameBufferPool = sync.Pool{
+	New: func() interface{} {
+		buffer := make([]byte, 0, PoolBufferSize+1024)
+		return &buffer
+	},
+}
+
+// An empty buffer to encode a frame into, see AppendFrame. Buffers go
+// around by pointer, so returning them to the pool does not allocate.
+func GetFrameBuffer() *[]byte {
+	buffer := frameBufferPool.Get().(*[]byte)
+	*buffer = (*buffer)[:0]
+	return buffer
+}
+
+// Returns a buffer from GetFrameBuffer to the pool, along with what was
+// appended to it. It must not be used after.
+func PutFrameBuffer(buffer *[]byte) {
+	if cap(*buffer) > maxPooledFrameBuffer {
+		return
+	}
+	frameBufferPool.Put(buffer)
+}
+
+// A buffer of size bytes, from the pool if it fits.
+func GetBuffer(size int) []byte {
+	if size > PoolBufferSize {
+		return make([]byte, size)
+	}
+	return (*bufferPool.Get().(*[]byte))[:size]
+}
+
+// Returns a buffer from GetBuffer to the pool. It must not be used after.
+func PutBuffer(buffer []byte) {
+	if cap(buffer) != PoolBufferSize {
+		return
+	}
+	buffer = buffer[:PoolBufferSize]
+	bufferPool.Put(&buffer)
+}
+
+// Data message with a payload from GetBuffer, that goes back to the pool
+// once the message is released.
+func PooledDataMessage(tunnelId string, clientId string, data []byte) *Message {
+	msg := DataMessage(tunnelId, clientId, data)
+	msg.buffer = data
+	return msg
+}
+
+// Returns a pooled payload to the pool, once the message is no longer
+// needed. Other messages are left as they are.
+func (self *Message) Release() {
+	if self.buffer != nil {
+		PutBuffer(self.buffer)
+		self.buffer = nil
+		self.Data = nil
+	}
+}
+
+// Splits a Data message in fragments of up to size bytes of payload, all of
+// them but the last flagged More. They share the payload, which only the
+// last one releases, so fragments must be released in order.
+func (self *Message) Fragment(size int) []*Message {
+	if len(self.Data) <= size {
+		return []*Message{self}
+	}
+
+	var fragments []*Message
+
+	for data := self.Data; len(data) > 0; {
+		length := len(data)
+		if length > size {
+			length = size
+		}
+
+		fragment := *self
+		fragment.Data = data[:length]
+		fragment.More = length < len(data)
+		if fragment.More {
+			fragment.buffer = nil
+		}
+		fragments = append(fragments, &fragment)
+
+		data = data[length:]
+	}
+
+	return fragments
+}
@@ -0,0 +1,87 @@
+package messages
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Names of the codecs, also used as websocket subprotocols.
+const (
+	BinaryCodecName = "tunneler.binary.v1"
+	JsonCodecName   = "tunneler.json"
+)
+
+// Encoding of messages on a transport.
+type Codec interface {
+	Name() string
+	// Whether the encoding is binary or text.
+	Binary() bool
+	Marshal(msg *Message) ([]byte, error)
+	// Appends the encoded message to buffer, as Marshal would return it
+	Append(buffer []byte, msg *Message) ([]byte, error)
+	Unmarshal(data []byte, msg *Message) error
+}
+
+var (
+	BinaryCodec Codec = binaryCodec{}
+	// Legacy codec, kept for peers that do not negotiate one.
+	JsonCodec Codec = jsonCodec{}
+)
+
+// Codecs in order of preference
+var Codecs = []Codec{BinaryCodec, JsonCodec}
+
+func CodecByName(name string) (Codec, error) {
+	for _, codec := range Codecs {
+		if codec.Name() == name {
+			return codec, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown codec %s", name)
+}
+
+type binaryCodec struct{}
+
+func (binaryCodec) Name() string {
+	return BinaryCodecName
+}
+
+func (binaryCodec) Binary() bool {
+	return true
+}
+
+func (binaryCodec) Marshal(msg *Message) ([]byte, error) {
+	return msg.MarshalFrame()
+}
+
+func (binaryCodec) Append(buffer []byte, msg *Message) ([]byte, error) {
+	return msg.AppendFrame(buffer)
+}
+
+func (binaryCodec) Unmarshal(data []byte, msg *Message) error {
+	return msg.UnmarshalFrame(data)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return JsonCodecName
+}
+
+func (jsonCodec) Binary() bool {
+	return false
+}
+
+func (jsonCodec) Marshal(msg *Message) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+func (jsonCodec) Append(buffer []byte, msg *Message) ([]byte, error) {
+	data, err := json.Marshal(msg)
+	return append(buffer, data...), err
+}
+
+func (jsonCodec) Unmarshal(data []byte, msg *Message) error {
+	*msg = Message{}
+	return json.Unmarshal(data, msg)
+}
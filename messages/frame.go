@@ -0,0 +1,370 @@
+package messages
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Version of the binary frame format. Frames are version 1 unless they use
+// extended flags, that only peers announcing Feature.Priority read.
+const (
+	FrameVersion         = 1
+	ExtendedFrameVersion = 2
+)
+
+// Frame layout, integers in big endian:
+//
+//	version  uint8
+//	type     uint8
+//	flags    uint8
+//	extended uint8 flags, on version 2
+//	tunnel   uint8 length + id
+//	client   uint8 length + id
+//	seq      uvarint, if flagSeq
+//	ack      uvarint, if flagAck
+//	control  uvarint length + string for description, service, protocol
+//	         and session id, if flagControl
+//	hello    uvarint protocol version, uvarint length + software version and
+//	         uvarint count + uvarint length + string per feature, if flagHello
+//	window   uvarint, if flagWindow
+//	code     uint8 length + string, if flagCode
+//	compression uint8 length + string, if flagCompression
+//	         (flagMore has no field, it marks a fragment)
+//	priority uint8 length + string, if extendedFlagPriority
+//	length   uint32
+//	payload  length bytes
+const (
+	flagSeq = 1 << iota
+	flagAck
+	flagControl
+	flagHello
+	flagWindow
+	flagCode
+	flagCompression
+	flagMore
+)
+
+const (
+	extendedFlagPriority = 1 << iota
+)
+
+// Codes are appended, never reordered
+var frameTypes = []string{
+	MessageType.Data,
+	MessageType.Ack,
+	MessageType.OpenSession,
+	MessageType.SessionReady,
+	MessageType.ResumeSession,
+	MessageType.SessionResumed,
+	MessageType.CloseSession,
+	MessageType.CreateLocalTunnel,
+	MessageType.LocalTunnelReady,
+	MessageType.CloseLocalTunnel,
+	MessageType.CreateRemoteTunnel,
+	MessageType.RemoteTunnelReady,
+	MessageType.CloseRemoteTunnel,
+	MessageType.Error,
+	MessageType.Hello,
+	MessageType.WindowUpdate,
+	MessageType.Open,
+	MessageType.OpenAck,
+	MessageType.Close,
+	MessageType.Reset,
+	MessageType.Noise,
+	MessageType.Encrypted,
+}
+
+var frameTypeCodes = func() map[string]byte {
+	codes := make(map[string]byte, len(frameTypes))
+	for code, name := range frameTypes {
+		codes[name] = byte(code)
+	}
+	return codes
+}()
+
+var errShortFrame = errors.New("short binary frame")
+
+// Encodes the message as a binary frame.
+func (self *Message) MarshalFrame() ([]byte, error) {
+	return self.AppendFrame(nil)
+}
+
+// Appends the message encoded as a binary frame to buffer, growing it once
+// if it does not fit.
+func (self *Message) AppendFrame(buffer []byte) ([]byte, error) {
+	typeCode, ok := frameTypeCodes[self.Type]
+	if !ok {
+		return nil, fmt.Errorf("message type %q has no frame type", self.Type)
+	}
+
+	if len(self.TunnelId) > 0xff || len(self.ClientId) > 0xff || len(self.Code) > 0xff ||
+		len(self.Compression) > 0xff || len(self.Priority) > 0xff {
+		return nil, errors.New("tunnel and client ids, error codes, compressions and priorities must fit 255 bytes")
+	}
+
+	var flags, extendedFlags byte
+	size := 4 + 2 + len(self.TunnelId) + len(self.ClientId) + 4 + len(self.Data)
+
+	if self.Seq != 0 {
+		flags |= flagSeq
+		size += binary.MaxVarintLen64
+	}
+	if self.Ack != 0 {
+		flags |= flagAck
+		size += binary.MaxVarintLen64
+	}
+	if self.Description != "" || self.Service != "" || self.Protocol != "" || self.SessionId != "" {
+		flags |= flagControl
+		size += 4*binary.MaxVarintLen64 + len(self.Description) + len(self.Service) + len(self.Protocol) + len(self.SessionId)
+	}
+	if self.ProtocolVersion != 0 || self.Version != "" || len(self.Features) > 0 {
+		flags |= flagHello
+		size += (3+len(self.Features))*binary.MaxVarintLen64 + len(self.Version)
+		for _, feature := range self.Features {
+			size += len(feature)
+		}
+	}
+	if self.Window != 0 {
+		flags |= flagWindow
+		size += binary.MaxVarintLen64
+	}
+	if self.Code != "" {
+		flags |= flagCode
+		size += 1 + len(self.Code)
+	}
+	if self.Compression != "" {
+		flags |= flagCompression
+		size += 1 + len(self.Compression)
+	}
+
+	if self.More {
+		flags |= flagMore
+	}
+	if self.Priority != "" {
+		extendedFlags |= extendedFlagPriority
+		size += 1 + len(self.Priority)
+	}
+
+	if cap(buffer)-len(buffer) < size {
+		grown := make([]byte, len(buffer), len(buffer)+size)
+		copy(grown, buffer)
+		buffer = grown
+	}
+
+	if extendedFlags != 0 {
+		buffer = append(buffer, ExtendedFrameVersion, typeCode, flags, extendedFlags)
+	} else {
+		buffer = append(buffer, FrameVersion, typeCode, flags)
+	}
+
+	buffer = append(buffer, byte(len(self.TunnelId)))
+	buffer = append(buffer, self.TunnelId...)
+	buffer = append(buffer, byte(len(self.ClientId)))
+	buffer = append(buffer, self.ClientId...)
+
+	if flags&flagSeq != 0 {
+		buffer = binary.AppendUvarint(buffer, self.Seq)
+	}
+	if flags&flagAck != 0 {
+		buffer = binary.AppendUvarint(buffer, self.Ack)
+	}
+	if flags&flagControl != 0 {
+		for _, value := range []string{self.Description, self.Service, self.Protocol, self.SessionId} {
+			buffer = binary.AppendUvarint(buffer, uint64(len(value)))
+			buffer = append(buffer, value...)
+		}
+	}
+	if flags&flagHello != 0 {
+		buffer = binary.AppendUvarint(buffer, uint64(self.ProtocolVersion))
+		buffer = binary.AppendUvarint(buffer, uint64(len(self.Version)))
+		buffer = append(buffer, self.Version...)
+		buffer = binary.AppendUvarint(buffer, uint64(len(self.Features)))
+		for _, feature := range self.Features {
+			buffer = binary.AppendUvarint(buffer, uint64(len(feature)))
+			buffer = append(buffer, feature...)
+		}
+	}
+	if flags&flagWindow != 0 {
+		buffer = binary.AppendUvarint(buffer, uint64(self.Window))
+	}
+	if flags&flagCode != 0 {
+		buffer = append(buffer, byte(len(self.Code)))
+		buffer = append(buffer, self.Code...)
+	}
+	if flags&flagCompression != 0 {
+		buffer = append(buffer, byte(len(self.Compression)))
+		buffer = append(buffer, self.Compression...)
+	}
+	if extendedFlags&extendedFlagPriority != 0 {
+		buffer = append(buffer, byte(len(self.Priority)))
+		buffer = append(buffer, self.Priority...)
+	}
+
+	buffer = binary.BigEndian.AppendUint32(buffer, uint32(len(self.Data)))
+	buffer = append(buffer, self.Data...)
+
+	return buffer, nil
+}
+
+// Decodes a binary frame. Data points into frame, which must not be reused.
+func (self *Message) UnmarshalFrame(frame []byte) error {
+	*self = Message{}
+
+	if len(frame) < 3 {
+		return errShortFrame
+	}
+
+	if frame[0] != FrameVersion && frame[0] != ExtendedFrameVersion {
+		return fmt.Errorf("unsupported frame version %d", frame[0])
+	}
+
+	if int(frame[1]) >= len(frameTypes) {
+		return fmt.Errorf("unknown frame type %d", frame[1])
+	}
+
+	self.Type = frameTypes[frame[1]]
+	version := frame[0]
+	flags := frame[2]
+	frame = frame[3:]
+
+	var extendedFlags byte
+	if version == ExtendedFrameVersion {
+		if len(frame) < 1 {
+			return errShortFrame
+		}
+		extendedFlags = frame[0]
+		frame = frame[1:]
+	}
+
+	var err error
+
+	if self.TunnelId, frame, err = consumeShortString(frame); err != nil {
+		return err
+	}
+	if self.ClientId, frame, err = consumeShortString(frame); err != nil {
+		return err
+	}
+
+	if flags&flagSeq != 0 {
+		if self.Seq, frame, err = consumeUvarint(frame); err != nil {
+			return err
+		}
+	}
+	if flags&flagAck != 0 {
+		if self.Ack, frame, err = consumeUvarint(frame); err != nil {
+			return err
+		}
+	}
+	if flags&flagControl != 0 {
+		for _, value := range []*string{&self.Description, &self.Service, &self.Protocol, &self.SessionId} {
+			if *value, frame, err = consumeString(frame); err != nil {
+				return err
+			}
+		}
+	}
+	if flags&flagHello != 0 {
+		if frame, err = self.consumeHello(frame); err != nil {
+			return err
+		}
+	}
+	if flags&flagWindow != 0 {
+		var window uint64
+		if window, frame, err = consumeUvarint(frame); err != nil {
+			return err
+		}
+		self.Window = uint32(window)
+	}
+	if flags&flagCode != 0 {
+		if self.Code, frame, err = consumeShortString(frame); err != nil {
+			return err
+		}
+	}
+	if flags&flagCompression != 0 {
+		if self.Compression, frame, err = consumeShortString(frame); err != nil {
+			return err
+		}
+	}
+
+	if extendedFlags&extendedFlagPriority != 0 {
+		if self.Priority, frame, err = consumeShortString(frame); err != nil {
+			return err
+		}
+	}
+
+	self.More = flags&flagMore != 0
+
+	if len(frame) < 4 {
+		return errShortFrame
+	}
+
+	length := binary.BigEndian.Uint32(frame)
+	frame = frame[4:]
+
+	if uint32(len(frame)) != length {
+		return fmt.Errorf("frame payload of %d bytes, expected %d", len(frame), length)
+	}
+
+	if length > 0 {
+		self.Data = frame
+	}
+
+	return nil
+}
+
+func (self *Message) consumeHello(frame []byte) ([]byte, error) {
+	protocolVersion, frame, err := consumeUvarint(frame)
+	if err != nil {
+		return nil, err
+	}
+	self.ProtocolVersion = uint32(protocolVersion)
+
+	if self.Version, frame, err = consumeString(frame); err != nil {
+		return nil, err
+	}
+
+	count, frame, err := consumeUvarint(frame)
+	if err != nil {
+		return nil, err
+	}
+	if count > uint64(len(frame)) {
+		return nil, errShortFrame
+	}
+
+	for i := uint64(0); i < count; i++ {
+		var feature string
+		if feature, frame, err = consumeString(frame); err != nil {
+			return nil, err
+		}
+		self.Features = append(self.Features, feature)
+	}
+
+	return frame, nil
+}
+
+func consumeShortString(frame []byte) (string, []byte, error) {
+	if len(frame) < 1 || len(frame) < 1+int(frame[0]) {
+		return "", nil, errShortFrame
+	}
+	length := int(frame[0])
+	return string(frame[1 : 1+length]), frame[1+length:], nil
+}
+
+func consumeUvarint(frame []byte) (uint64, []byte, error) {
+	value, n := binary.Uvarint(frame)
+	if n <= 0 {
+		return 0, nil, errShortFrame
+	}
+	return value, frame[n:], nil
+}
+
+func consumeString(frame []byte) (string, []byte, error) {
+	length, frame, err := consumeUvarint(frame)
+	if err != nil {
+		return "", nil, err
+	}
+	if uint64(len(frame)) < length {
+		return "", nil, errShortFrame
+	}
+	return string(frame[:length]), frame[length:], nil
+}
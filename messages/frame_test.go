@@ -0,0 +1,251 @@
+package messages
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+var payloadSizes = []int{64, 16 * 1024, 1024 * 1024}
+
+func frameTestMessages() map[string]*Message {
+	return map[string]*Message{
+		"data":    DataMessage("1", "42", []byte("payload")),
+		"empty":   CloseMessage("1", "42"),
+		"session": ResumeSessionMessage("session-id", 1<<40),
+		"control": CreateLocalTunnelMessage("7", "udp", "127.0.0.1:53", Compression.Zstd, ""),
+		"hello": {
+			Type:            MessageType.Hello,
+			ProtocolVersion: ProtocolVersion,
+			Version:         "1.2.3",
+			Features:        []string{Feature.Resume, Feature.Flow, CodecFeaturePrefix + BinaryCodecName},
+		},
+		"window": WindowUpdateMessage("1", "42", 256*1024),
+		"reset":  ResetMessage("1", "42", ErrorCode.Refused, fmt.Errorf("connection refused")),
+		"fragment": {
+			Type:     MessageType.Data,
+			TunnelId: "1",
+			ClientId: "42",
+			Seq:      12,
+			Ack:      11,
+			More:     true,
+			Data:     bytes.Repeat([]byte{0xaa}, 1000),
+		},
+	}
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	for name, msg := range frameTestMessages() {
+		t.Run(name, func(t *testing.T) {
+			frame, err := msg.MarshalFrame()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if frame[0] != FrameVersion {
+				t.Errorf("frame version %d, expected %d", frame[0], FrameVersion)
+			}
+
+			var decoded Message
+			if err := decoded.UnmarshalFrame(frame); err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(&decoded, msg) {
+				t.Errorf("decoded %+v, expected %+v", decoded, *msg)
+			}
+		})
+	}
+}
+
+func TestExtendedFrameRoundTrip(t *testing.T) {
+	msg := CreateRemoteTunnelMessage("3", "tcp", "8080", "", Priority.Interactive)
+
+	frame, err := msg.MarshalFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if frame[0] != ExtendedFrameVersion {
+		t.Errorf("frame version %d, expected %d", frame[0], ExtendedFrameVersion)
+	}
+
+	var decoded Message
+	if err := decoded.UnmarshalFrame(frame); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(&decoded, msg) {
+		t.Errorf("decoded %+v, expected %+v", decoded, *msg)
+	}
+}
+
+func TestMarshalFrameOversizedFields(t *testing.T) {
+	long := string(bytes.Repeat([]byte("x"), 256))
+
+	for name, msg := range map[string]*Message{
+		"tunnel":   DataMessage(long, "1", nil),
+		"client":   DataMessage("1", long, nil),
+		"code":     ResetMessage("1", "1", long, nil),
+		"priority": CreateLocalTunnelMessage("1", "tcp", "127.0.0.1:22", "", long),
+		"type":     {Type: "Unknown"},
+	} {
+		if _, err := msg.MarshalFrame(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestUnmarshalMalformedFrame(t *testing.T) {
+	valid, err := (&Message{
+		Type:     MessageType.Data,
+		TunnelId: "1",
+		ClientId: "2",
+		Seq:      3,
+		Service:  "service",
+		Data:     []byte("payload"),
+	}).MarshalFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hugeLength := binary.AppendUvarint(nil, 1<<62)
+
+	cases := map[string][]byte{
+		"empty":             {},
+		"short header":      {FrameVersion, 0},
+		"unknown version":   {9, 0, 0, 0, 0, 0, 0, 0, 0},
+		"unknown type":      {FrameVersion, 0xff, 0, 0, 0, 0, 0, 0, 0},
+		"no extended flags": {ExtendedFrameVersion, 0, 0},
+		"short tunnel id":   {FrameVersion, 0, 0, 10, 'a'},
+		"short client id":   {FrameVersion, 0, 0, 0, 10, 'a'},
+		"missing seq":       {FrameVersion, 0, flagSeq, 0, 0},
+		"overlong seq":      append([]byte{FrameVersion, 0, flagSeq, 0, 0}, bytes.Repeat([]byte{0xff}, 11)...),
+		"huge string":       append([]byte{FrameVersion, 0, flagControl, 0, 0}, hugeLength...),
+		"huge features": append([]byte{FrameVersion, 0, flagHello, 0, 0, 1, 0},
+			hugeLength...),
+		"missing length":    {FrameVersion, 0, 0, 0, 0},
+		"huge payload":      {FrameVersion, 0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 'a'},
+		"trailing bytes":    append(append([]byte(nil), valid...), 'x'),
+		"missing priority":  {ExtendedFrameVersion, 0, 0, extendedFlagPriority, 0, 0},
+		"truncated payload": valid[:len(valid)-1],
+	}
+
+	for name, frame := range cases {
+		t.Run(name, func(t *testing.T) {
+			var msg Message
+			if err := msg.UnmarshalFrame(frame); err == nil {
+				t.Errorf("expected an error, decoded %+v", msg)
+			}
+		})
+	}
+
+	// Every truncation of a valid frame
+	for length := 0; length < len(valid); length++ {
+		var msg Message
+		if err := msg.UnmarshalFrame(valid[:length]); err == nil {
+			t.Errorf("frame truncated to %d bytes: expected an error", length)
+		}
+	}
+}
+
+func TestProtoRoundTrip(t *testing.T) {
+	for name, msg := range frameTestMessages() {
+		t.Run(name, func(t *testing.T) {
+			var decoded Message
+			if err := decoded.UnmarshalProto(msg.MarshalProto()); err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(&decoded, msg) {
+				t.Errorf("decoded %+v, expected %+v", decoded, *msg)
+			}
+		})
+	}
+}
+
+func benchmarkPayloads(b *testing.B, run func(b *testing.B, msg *Message)) {
+	for _, size := range payloadSizes {
+		msg := DataMessage("1", "42", bytes.Repeat([]byte{0xaa}, size))
+		msg.Seq = 1000
+
+		b.Run(fmt.Sprintf("%dB", size), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			run(b, msg)
+		})
+	}
+}
+
+func BenchmarkMarshalFrame(b *testing.B) {
+	benchmarkPayloads(b, func(b *testing.B, msg *Message) {
+		for i := 0; i < b.N; i++ {
+			if _, err := msg.MarshalFrame(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkMarshalJSON(b *testing.B) {
+	benchmarkPayloads(b, func(b *testing.B, msg *Message) {
+		for i := 0; i < b.N; i++ {
+			if _, err := json.Marshal(msg); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkMarshalProto(b *testing.B) {
+	benchmarkPayloads(b, func(b *testing.B, msg *Message) {
+		for i := 0; i < b.N; i++ {
+			msg.MarshalProto()
+		}
+	})
+}
+
+func BenchmarkAppendFrame(b *testing.B) {
+	benchmarkPayloads(b, func(b *testing.B, msg *Message) {
+		for i := 0; i < b.N; i++ {
+			buffer := GetFrameBuffer()
+			frame, err := msg.AppendFrame(*buffer)
+			if err != nil {
+				b.Fatal(err)
+			}
+			*buffer = frame
+			PutFrameBuffer(buffer)
+		}
+	})
+}
+
+func BenchmarkUnmarshalFrame(b *testing.B) {
+	benchmarkPayloads(b, func(b *testing.B, msg *Message) {
+		frame, _ := msg.MarshalFrame()
+		var decoded Message
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := decoded.UnmarshalFrame(frame); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkUnmarshalJSON(b *testing.B) {
+	benchmarkPayloads(b, func(b *testing.B, msg *Message) {
+		data, _ := json.Marshal(msg)
+		var decoded Message
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := JsonCodec.Unmarshal(data, &decoded); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,86 @@
+package messages
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Version of the protocol spoken after Hello. Peers that do not send Hello
+// speak the legacy protocol.
+const (
+	ProtocolVersion    = 1
+	MinProtocolVersion = 1
+)
+
+// Optional features announced on Hello. Codecs are announced as
+// "codec:" + codec name.
+var Feature = struct {
+	Resume  string
+	Udp     string
+	Flow    string
+	Streams string
+	Zstd    string
+	// Tunnel priorities, and the version 2 frames that carry them
+	Priority string
+}{
+	Resume:   "resume",
+	Udp:      "udp",
+	Flow:     "flow",
+	Streams:  "streams",
+	Zstd:     "compression:zstd",
+	Priority: "priority",
+}
+
+const CodecFeaturePrefix = "codec:"
+
+// Each peer announces the largest frame it accepts as "max-frame-size:" +
+// bytes. Peers that announce it reassemble fragmented Data.
+const MaxFrameSizeFeaturePrefix = "max-frame-size:"
+
+func MaxFrameSizeFeature(size int) string {
+	return MaxFrameSizeFeaturePrefix + strconv.Itoa(size)
+}
+
+func HelloMessage(protocolVersion uint32, version string, features []string) *Message {
+	return &Message{
+		Type:            MessageType.Hello,
+		ProtocolVersion: protocolVersion,
+		Version:         version,
+		Features:        features,
+	}
+}
+
+func (self *Message) HasFeature(feature string) bool {
+	for _, candidate := range self.Features {
+		if candidate == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// Largest frame the peer accepts, 0 if it did not announce it.
+func (self *Message) MaxFrameSize() int {
+	for _, feature := range self.Features {
+		if strings.HasPrefix(feature, MaxFrameSizeFeaturePrefix) {
+			size, err := strconv.Atoi(strings.TrimPrefix(feature, MaxFrameSizeFeaturePrefix))
+			if err == nil && size > 0 {
+				return size
+			}
+		}
+	}
+	return 0
+}
+
+// Features of ours the peer also announced on its Hello.
+func (self *Message) CommonFeatures(features []string) []string {
+	var common []string
+
+	for _, feature := range features {
+		if self.HasFeature(feature) {
+			common = append(common, feature)
+		}
+	}
+
+	return common
+}
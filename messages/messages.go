@@ -9,6 +9,14 @@ func New() *Message {
 }
 
 var MessageType = struct {
+	Hello          string
+	OpenSession    string
+	SessionReady   string
+	ResumeSession  string
+	SessionResumed string
+	CloseSession   string
+	Ack            string
+
 	CreateRemoteTunnel string
 	RemoteTunnelReady  string
 	CloseRemoteTunnel  string
@@ -17,9 +25,25 @@ var MessageType = struct {
 	LocalTunnelReady  string
 	CloseLocalTunnel  string
 
-	Data  string
-	Error string
+	Open         string
+	OpenAck      string
+	Close        string
+	Reset        string
+	Data         string
+	WindowUpdate string
+	Error        string
+
+	Noise     string
+	Encrypted string
 }{
+	Hello:          "Hello",
+	OpenSession:    "OpenSession",
+	SessionReady:   "SessionReady",
+	ResumeSession:  "ResumeSession",
+	SessionResumed: "SessionResumed",
+	CloseSession:   "CloseSession",
+	Ack:            "Ack",
+
 	CreateLocalTunnel: "CreateLocalTunnel",
 	LocalTunnelReady:  "LocalTunnelReady",
 	CloseLocalTunnel:  "CloseLocalTunnel",
@@ -28,42 +52,149 @@ var MessageType = struct {
 	RemoteTunnelReady:  "RemoteTunnelReady",
 	CloseRemoteTunnel:  "CloseRemoteTunnel",
 
-	Error: "Error",
-	Data:  "Data",
+	Open:         "Open",
+	OpenAck:      "OpenAck",
+	Close:        "Close",
+	Reset:        "Reset",
+	Error:        "Error",
+	Data:         "Data",
+	WindowUpdate: "WindowUpdate",
+
+	Noise:     "Noise",
+	Encrypted: "Encrypted",
+}
+
+func OpenSessionMessage() *Message {
+	return &Message{
+		Type: MessageType.OpenSession,
+	}
+}
+
+func SessionReadyMessage(sessionId string) *Message {
+	return &Message{
+		Type:      MessageType.SessionReady,
+		SessionId: sessionId,
+	}
+}
+
+func ResumeSessionMessage(sessionId string, ack uint64) *Message {
+	return &Message{
+		Type:      MessageType.ResumeSession,
+		SessionId: sessionId,
+		Ack:       ack,
+	}
+}
+
+func SessionResumedMessage(sessionId string, ack uint64) *Message {
+	return &Message{
+		Type:      MessageType.SessionResumed,
+		SessionId: sessionId,
+		Ack:       ack,
+	}
+}
+
+func CloseSessionMessage() *Message {
+	return &Message{
+		Type: MessageType.CloseSession,
+	}
+}
+
+func AckMessage() *Message {
+	return &Message{
+		Type: MessageType.Ack,
+	}
+}
+
+// A Noise handshake message. The first one names the Noise protocol.
+func NoiseMessage(protocolName string, handshake []byte) *Message {
+	return &Message{
+		Type:     MessageType.Noise,
+		Protocol: protocolName,
+		Data:     handshake,
+	}
+}
+
+// Carries an encrypted message once the Noise handshake is done.
+func EncryptedMessage(ciphertext []byte) *Message {
+	return &Message{
+		Type: MessageType.Encrypted,
+		Data: ciphertext,
+	}
+}
+
+// Session messages manage the session itself so they are never sequenced
+// nor replayed.
+func (self *Message) IsSessionMessage() bool {
+	switch self.Type {
+	case MessageType.Hello, MessageType.OpenSession, MessageType.SessionReady, MessageType.ResumeSession,
+		MessageType.SessionResumed, MessageType.CloseSession, MessageType.Ack:
+		return true
+	}
+	return false
 }
 
-func CreateLocalTunnelMessage(protocol string, service string) *Message {
+func CreateLocalTunnelMessage(tunnelId string, protocol string, service string, compression string, priority string) *Message {
 	return &Message{
-		Type:     MessageType.CreateLocalTunnel,
-		Service:  service,
-		Protocol: protocol,
+		Type:        MessageType.CreateLocalTunnel,
+		TunnelId:    tunnelId,
+		Service:     service,
+		Protocol:    protocol,
+		Compression: compression,
+		Priority:    priority,
 	}
 }
 
-func CreateRemoteTunnelMessage(protocol string, service string) *Message {
+func CreateRemoteTunnelMessage(tunnelId string, protocol string, service string, compression string, priority string) *Message {
 	return &Message{
-		Type:     MessageType.CreateRemoteTunnel,
-		Service:  service,
-		Protocol: protocol,
+		Type:        MessageType.CreateRemoteTunnel,
+		TunnelId:    tunnelId,
+		Service:     service,
+		Protocol:    protocol,
+		Compression: compression,
+		Priority:    priority,
 	}
 }
 
-func RemoteTunnelReadyMessage(protocol string, service string) *Message {
+func RemoteTunnelReadyMessage(tunnelId string, protocol string, service string, compression string) *Message {
 	return &Message{
-		Type:     MessageType.RemoteTunnelReady,
-		Service:  service,
-		Protocol: protocol,
+		Type:        MessageType.RemoteTunnelReady,
+		TunnelId:    tunnelId,
+		Service:     service,
+		Protocol:    protocol,
+		Compression: compression,
 	}
 }
 
-func LocalTunnelReadyMessage(protocol string, service string) *Message {
+func LocalTunnelReadyMessage(tunnelId string, protocol string, service string, compression string) *Message {
 	return &Message{
-		Type:     MessageType.LocalTunnelReady,
-		Service:  service,
-		Protocol: protocol,
+		Type:        MessageType.LocalTunnelReady,
+		TunnelId:    tunnelId,
+		Service:     service,
+		Protocol:    protocol,
+		Compression: compression,
 	}
 }
 
+// Scheduling classes of tunnels, sharing the session by weight
+var Priority = struct {
+	Interactive string
+	Normal      string
+	Bulk        string
+}{
+	Interactive: "interactive",
+	Normal:      "",
+	Bulk:        "bulk",
+}
+
+// Compressions of Data payloads
+var Compression = struct {
+	None string
+	Zstd string
+}{
+	None: "",
+	Zstd: "zstd",
+}
+
 func ErrorMessage(err error) *Message {
 	return &Message{
 		Type:        MessageType.Error,
@@ -71,19 +202,135 @@ func ErrorMessage(err error) *Message {
 	}
 }
 
-func DataMessage(clientId string, data []byte) *Message {
+func TunnelErrorMessage(tunnelId string, err error) *Message {
+	return &Message{
+		Type:        MessageType.Error,
+		TunnelId:    tunnelId,
+		Description: fmt.Sprint(err),
+	}
+}
+
+func CloseTunnelMessage(closeType string, tunnelId string) *Message {
+	return &Message{
+		Type:     closeType,
+		TunnelId: tunnelId,
+	}
+}
+
+func DataMessage(tunnelId string, clientId string, data []byte) *Message {
 	return &Message{
 		Type:     MessageType.Data,
 		Data:     data,
+		TunnelId: tunnelId,
 		ClientId: clientId,
 	}
 }
 
+// Machine readable reasons of a Reset
+var ErrorCode = struct {
+	Refused      string
+	Timeout      string
+	PolicyDenied string
+	Unreachable  string
+	Reset        string
+	Internal     string
+	TooLarge     string
+	Overflow     string
+	FlowControl  string
+	Protocol     string
+}{
+	Refused:      "refused",
+	Timeout:      "timeout",
+	PolicyDenied: "policy_denied",
+	Unreachable:  "unreachable",
+	Reset:        "reset",
+	Internal:     "internal",
+	TooLarge:     "too_large",
+	Overflow:     "overflow",
+	FlowControl:  "flow_control",
+	Protocol:     "protocol",
+}
+
+// Asks the exit point to connect a new client.
+func OpenMessage(tunnelId string, clientId string) *Message {
+	return &Message{
+		Type:     MessageType.Open,
+		TunnelId: tunnelId,
+		ClientId: clientId,
+	}
+}
+
+func OpenAckMessage(tunnelId string, clientId string) *Message {
+	return &Message{
+		Type:     MessageType.OpenAck,
+		TunnelId: tunnelId,
+		ClientId: clientId,
+	}
+}
+
+// The sender will not send more data of the client.
+func CloseMessage(tunnelId string, clientId string) *Message {
+	return &Message{
+		Type:     MessageType.Close,
+		TunnelId: tunnelId,
+		ClientId: clientId,
+	}
+}
+
+// Aborts the client, in both directions.
+func ResetMessage(tunnelId string, clientId string, code string, err error) *Message {
+	return &Message{
+		Type:        MessageType.Reset,
+		TunnelId:    tunnelId,
+		ClientId:    clientId,
+		Code:        code,
+		Description: fmt.Sprint(err),
+	}
+}
+
+// Messages about a single client of a tunnel.
+func (self *Message) IsClientMessage() bool {
+	switch self.Type {
+	case MessageType.Data, MessageType.WindowUpdate, MessageType.Open,
+		MessageType.OpenAck, MessageType.Close, MessageType.Reset:
+		return true
+	}
+	return false
+}
+
+// Gives the peer window more bytes of credit to send data of the client.
+func WindowUpdateMessage(tunnelId string, clientId string, window uint32) *Message {
+	return &Message{
+		Type:     MessageType.WindowUpdate,
+		TunnelId: tunnelId,
+		ClientId: clientId,
+		Window:   window,
+	}
+}
+
 type Message struct {
 	Type        string `json:"t"`
 	Description string `json:"d,omitempty"`
 	Service     string `json:"s,omitempty"`
 	Protocol    string `json:"p,omitempty"`
+	TunnelId    string `json:"i,omitempty"`
+	SessionId   string `json:"r,omitempty"`
+	Seq         uint64 `json:"n,omitempty"`
+	Ack         uint64 `json:"a,omitempty"`
 	ClientId    string `json:"c,omitempty"`
 	Data        []byte `json:"b,omitempty"`
+	Window      uint32 `json:"u,omitempty"`
+	Code        string `json:"e,omitempty"`
+	// Compression of the tunnel on tunnel handshakes, of Data on data
+	Compression string `json:"z,omitempty"`
+	// Data is a fragment, continued on the next Data of the client
+	More bool `json:"m,omitempty"`
+	// Priority of the tunnel on tunnel requests
+	Priority string `json:"y,omitempty"`
+	// Pooled buffer of Data, see Release
+	buffer []byte
+
+	ProtocolVersion uint32   `json:"v,omitempty"`
+	Version         string   `json:"w,omitempty"`
+	Features        []string `json:"f,omitempty"`
 }
@@ -0,0 +1,214 @@
+package messages
+
+import (
+	"errors"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Field numbers from messages.proto
+const (
+	fieldType        protowire.Number = 1
+	fieldDescription protowire.Number = 2
+	fieldService     protowire.Number = 3
+	fieldProtocol    protowire.Number = 4
+	fieldTunnelId    protowire.Number = 5
+	fieldSessionId   protowire.Number = 6
+	fieldSeq         protowire.Number = 7
+	fieldAck         protowire.Number = 8
+	fieldClientId    protowire.Number = 9
+	fieldData        protowire.Number = 10
+
+	fieldProtocolVersion protowire.Number = 11
+	fieldVersion         protowire.Number = 12
+	fieldFeatures        protowire.Number = 13
+	fieldWindow          protowire.Number = 14
+	fieldCode            protowire.Number = 15
+	fieldCompression     protowire.Number = 16
+	fieldMore            protowire.Number = 17
+	fieldPriority        protowire.Number = 18
+)
+
+// Encodes the message as a protobuf tunneler.Message, in a buffer of its
+// exact size.
+func (self *Message) MarshalProto() []byte {
+	return self.AppendProto(make([]byte, 0, self.protoSize()))
+}
+
+// Appends the message encoded as a protobuf tunneler.Message to buffer.
+func (self *Message) AppendProto(buffer []byte) []byte {
+	buffer = appendString(buffer, fieldType, self.Type)
+	buffer = appendString(buffer, fieldDescription, self.Description)
+	buffer = appendString(buffer, fieldService, self.Service)
+	buffer = appendString(buffer, fieldProtocol, self.Protocol)
+	buffer = appendString(buffer, fieldTunnelId, self.TunnelId)
+	buffer = appendString(buffer, fieldSessionId, self.SessionId)
+	buffer = appendUint(buffer, fieldSeq, self.Seq)
+	buffer = appendUint(buffer, fieldAck, self.Ack)
+	buffer = appendString(buffer, fieldClientId, self.ClientId)
+
+	if len(self.Data) > 0 {
+		buffer = protowire.AppendTag(buffer, fieldData, protowire.BytesType)
+		buffer = protowire.AppendBytes(buffer, self.Data)
+	}
+
+	buffer = appendUint(buffer, fieldProtocolVersion, uint64(self.ProtocolVersion))
+	buffer = appendString(buffer, fieldVersion, self.Version)
+	buffer = appendUint(buffer, fieldWindow, uint64(self.Window))
+	buffer = appendString(buffer, fieldCode, self.Code)
+	buffer = appendString(buffer, fieldCompression, self.Compression)
+
+	if self.More {
+		buffer = appendUint(buffer, fieldMore, 1)
+	}
+	buffer = appendString(buffer, fieldPriority, self.Priority)
+
+	for _, feature := range self.Features {
+		buffer = protowire.AppendTag(buffer, fieldFeatures, protowire.BytesType)
+		buffer = protowire.AppendString(buffer, feature)
+	}
+
+	return buffer
+}
+
+func (self *Message) protoSize() int {
+	size := sizeString(fieldType, self.Type) + sizeString(fieldDescription, self.Description) +
+		sizeString(fieldService, self.Service) + sizeString(fieldProtocol, self.Protocol) +
+		sizeString(fieldTunnelId, self.TunnelId) + sizeString(fieldSessionId, self.SessionId) +
+		sizeUint(fieldSeq, self.Seq) + sizeUint(fieldAck, self.Ack) + sizeString(fieldClientId, self.ClientId) +
+		sizeUint(fieldProtocolVersion, uint64(self.ProtocolVersion)) + sizeString(fieldVersion, self.Version) +
+		sizeUint(fieldWindow, uint64(self.Window)) + sizeString(fieldCode, self.Code) +
+		sizeString(fieldCompression, self.Compression) + sizeString(fieldPriority, self.Priority)
+
+	if len(self.Data) > 0 {
+		size += protowire.SizeTag(fieldData) + protowire.SizeBytes(len(self.Data))
+	}
+	if self.More {
+		size += sizeUint(fieldMore, 1)
+	}
+	for _, feature := range self.Features {
+		size += protowire.SizeTag(fieldFeatures) + protowire.SizeBytes(len(feature))
+	}
+
+	return size
+}
+
+// Decodes a protobuf tunneler.Message. Unknown fields are skipped.
+func (self *Message) UnmarshalProto(buffer []byte) error {
+	*self = Message{}
+
+	for len(buffer) > 0 {
+		number, wireType, tagLen := protowire.ConsumeTag(buffer)
+		if tagLen < 0 {
+			return protowire.ParseError(tagLen)
+		}
+		buffer = buffer[tagLen:]
+
+		var valueLen int
+
+		switch {
+		case wireType == protowire.BytesType && !isVarintField(number):
+			var value []byte
+			value, valueLen = protowire.ConsumeBytes(buffer)
+			if valueLen < 0 {
+				return protowire.ParseError(valueLen)
+			}
+			self.setBytes(number, value)
+
+		case wireType == protowire.VarintType && isVarintField(number):
+			var value uint64
+			value, valueLen = protowire.ConsumeVarint(buffer)
+			if valueLen < 0 {
+				return protowire.ParseError(valueLen)
+			}
+			switch number {
+			case fieldSeq:
+				self.Seq = value
+			case fieldAck:
+				self.Ack = value
+			case fieldProtocolVersion:
+				self.ProtocolVersion = uint32(value)
+			case fieldWindow:
+				self.Window = uint32(value)
+			case fieldMore:
+				self.More = value != 0
+			}
+
+		default:
+			valueLen = protowire.ConsumeFieldValue(number, wireType, buffer)
+			if valueLen < 0 {
+				return errors.New("malformed protobuf message")
+			}
+		}
+
+		buffer = buffer[valueLen:]
+	}
+
+	return nil
+}
+
+func (self *Message) setBytes(number protowire.Number, value []byte) {
+	switch number {
+	case fieldType:
+		self.Type = string(value)
+	case fieldDescription:
+		self.Description = string(value)
+	case fieldService:
+		self.Service = string(value)
+	case fieldProtocol:
+		self.Protocol = string(value)
+	case fieldTunnelId:
+		self.TunnelId = string(value)
+	case fieldSessionId:
+		self.SessionId = string(value)
+	case fieldClientId:
+		self.ClientId = string(value)
+	case fieldData:
+		self.Data = append([]byte(nil), value...)
+	case fieldVersion:
+		self.Version = string(value)
+	case fieldFeatures:
+		self.Features = append(self.Features, string(value))
+	case fieldCode:
+		self.Code = string(value)
+	case fieldCompression:
+		self.Compression = string(value)
+	case fieldPriority:
+		self.Priority = string(value)
+	}
+}
+
+func isVarintField(number protowire.Number) bool {
+	return number == fieldSeq || number == fieldAck || number == fieldProtocolVersion || number == fieldWindow ||
+		number == fieldMore
+}
+
+func appendString(buffer []byte, number protowire.Number, value string) []byte {
+	if value == "" {
+		return buffer
+	}
+	buffer = protowire.AppendTag(buffer, number, protowire.BytesType)
+	return protowire.AppendString(buffer, value)
+}
+
+func sizeString(number protowire.Number, value string) int {
+	if value == "" {
+		return 0
+	}
+	return protowire.SizeTag(number) + protowire.SizeBytes(len(value))
+}
+
+func sizeUint(number protowire.Number, value uint64) int {
+	if value == 0 {
+		return 0
+	}
+	return protowire.SizeTag(number) + protowire.SizeVarint(value)
+}
+
+func appendUint(buffer []byte, number protowire.Number, value uint64) []byte {
+	if value == 0 {
+		return buffer
+	}
+	buffer = protowire.AppendTag(buffer, number, protowire.VarintType)
+	return protowire.AppendVarint(buffer, value)
+}